@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// querier answers MIGP queries, either from a MIGP server over HTTP or
+// locally from a snapshot
+type querier interface {
+	Query(ctx context.Context, username, password []byte) (migp.BreachStatus, []byte, error)
+	QueryCombined(ctx context.Context, username, password []byte) (migp.CombinedResult, error)
+	QueryBatch(ctx context.Context, credentials []migp.Credential) ([]migp.BatchResult, error)
+}
+
+// localQuerier runs the full MIGP flow locally, answering each request with
+// a server holding the OPRF key and buckets read from a snapshot
+type localQuerier struct {
+	client *migp.Client
+	server *migp.Server
+	kv     migp.Getter
+}
+
+// newLocalQuerier returns a querier for the buckets in snapshot, evaluated
+// by a server with the given configuration
+func newLocalQuerier(serverCfg migp.ServerConfig, snapshot *migp.Snapshot) (*localQuerier, error) {
+	server, err := migp.NewServer(serverCfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := migp.NewClient(snapshot.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &localQuerier{client: client, server: server, kv: snapshot}, nil
+}
+
+// Query queries a username and password
+func (q *localQuerier) Query(ctx context.Context, username, password []byte) (migp.BreachStatus, []byte, error) {
+	request, reqContext, err := q.client.Request(username, password)
+	if err != nil {
+		return migp.NotInBreach, nil, err
+	}
+	response, err := q.server.HandleRequest(request, q.kv)
+	if err != nil {
+		return migp.NotInBreach, nil, err
+	}
+	return reqContext.Finalize(response)
+}
+
+// QueryCombined queries a username and password and the username alone
+func (q *localQuerier) QueryCombined(ctx context.Context, username, password []byte) (migp.CombinedResult, error) {
+	request, reqContext, err := q.client.RequestCombined(username, password)
+	if err != nil {
+		return migp.CombinedResult{}, err
+	}
+	response, err := q.server.HandleRequest(request, q.kv)
+	if err != nil {
+		return migp.CombinedResult{}, err
+	}
+	return reqContext.FinalizeCombined(response)
+}
+
+// QueryBatch queries each credential in turn
+func (q *localQuerier) QueryBatch(ctx context.Context, credentials []migp.Credential) ([]migp.BatchResult, error) {
+	results := make([]migp.BatchResult, len(credentials))
+	for i, credential := range credentials {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		results[i].Status, results[i].Metadata, results[i].Err = q.Query(ctx, credential.Username, credential.Password)
+	}
+	return results, nil
+}
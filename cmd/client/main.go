@@ -8,31 +8,55 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/erikathea/migp-go/pkg/migp"
 )
 
 func main() {
-	var targetURL, configFile, inputFilename string
-	var dumpConfig, showPassword bool
+	var targetURL, bucketURL, configFile, inputFilename, snapshotFile, serverConfigFile string
+	var dumpConfig, showPassword, combined, binaryRequests bool
+	var batchSize, retries int
+	var timeout time.Duration
 	var err error
 
 	flag.StringVar(&configFile, "config", "", "Client configuration file (default: retrieve from server)")
 	flag.BoolVar(&dumpConfig, "dump-config", false, "Dump the client configuration to stdout and exit")
 	flag.BoolVar(&showPassword, "show-password", false, "Show the password in the output")
+	flag.BoolVar(&combined, "combined", false, "Also check the username alone, in the same request")
+	flag.BoolVar(&binaryRequests, "binary", false, "send single queries in the binary request encoding instead of JSON")
+	flag.IntVar(&batchSize, "batch-size", 100, "number of credentials to query per batch request")
 	flag.StringVar(&inputFilename, "infile", "-", "input file of credentials to query in the format <username>:<password> ('-' for stdin)")
 	flag.StringVar(&targetURL, "target", "http://localhost:8080", "target MIGP server")
+	flag.StringVar(&bucketURL, "bucket-url", "", "fetch buckets from a static export at this URL and only send the OPRF evaluation to the target server")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "timeout for each HTTP request to the server")
+	flag.IntVar(&retries, "retries", 2, "number of times to retry requests that fail with a server error")
+	flag.StringVar(&snapshotFile, "snapshot", "", "query a bucket snapshot locally instead of a MIGP server")
+	flag.StringVar(&serverConfigFile, "server-config", "", "server configuration file holding the OPRF key, for querying a snapshot")
 
 	flag.Parse()
 
+	if batchSize > migp.MaxBatchSize {
+		batchSize = migp.MaxBatchSize
+	}
+
 	var cfg migp.Config
-	if configFile != "" {
+	var snapshot *migp.Snapshot
+	if snapshotFile != "" {
+		// use the config the snapshot was written with
+		if snapshot, err = migp.OpenSnapshot(snapshotFile); err != nil {
+			log.Fatal(err)
+		}
+		defer snapshot.Close()
+		cfg = snapshot.Config
+	} else if configFile != "" {
 		// use the provided config file
 		data, err := os.ReadFile(configFile)
 		if err != nil {
@@ -81,37 +105,137 @@ func main() {
 		defer inputFile.Close()
 	}
 
+	var client querier
+	if snapshot != nil {
+		if serverConfigFile == "" {
+			log.Fatal("Querying a snapshot requires the server configuration given with -server-config")
+		}
+		data, err := os.ReadFile(serverConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var serverCfg migp.ServerConfig
+		if err := json.Unmarshal(data, &serverCfg); err != nil {
+			log.Fatal(err)
+		}
+		if client, err = newLocalQuerier(serverCfg, snapshot); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		opts := []migp.HTTPClientOption{
+			migp.WithHTTPClient(&http.Client{Timeout: timeout}),
+			migp.WithRetries(retries, 500*time.Millisecond),
+			migp.WithUserAgent("migp-go-client"),
+		}
+		if binaryRequests {
+			opts = append(opts, migp.WithBinaryRequests())
+		}
+		if bucketURL != "" {
+			opts = append(opts, migp.WithBucketURL(bucketURL))
+		}
+		if client, err = migp.NewHTTPClient(cfg, targetURL, opts...); err != nil {
+			log.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	failed := false
+	report := func(username, password []byte, status migp.BreachStatus, metadata []byte, matches []string, err error) {
+		if !showPassword {
+			password = nil
+		}
+		if err != nil {
+			failed = true
+		}
+		if printResult(username, password, status, metadata, matches, err) != nil {
+			os.Exit(1)
+		}
+	}
+
+	var batch []migp.Credential
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		results, err := client.QueryBatch(ctx, batch)
+		for i, credential := range batch {
+			if err != nil {
+				report(credential.Username, credential.Password, 0, nil, nil, err)
+			} else {
+				report(credential.Username, credential.Password, results[i].Status, results[i].Metadata, nil, results[i].Err)
+			}
+		}
+		batch = batch[:0]
+	}
+
 	scanner := bufio.NewScanner(inputFile)
 	for scanner.Scan() {
 		fields := bytes.SplitN(scanner.Bytes(), []byte(":"), 2)
 		if len(fields) < 2 {
 			continue
 		}
-		username, password := fields[0], fields[1]
-		if status, metadata, err := migp.Query(cfg, targetURL+"/evaluate", username, password); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		} else {
-
-			if !showPassword {
-				password = nil
+		// copy out of the scanner's buffer, which is reused per line
+		username, password := append([]byte{}, fields[0]...), append([]byte{}, fields[1]...)
+		if combined {
+			result, err := client.QueryCombined(ctx, username, password)
+			var matches []string
+			for _, match := range result.Matches {
+				matches = append(matches, match.Status().String())
 			}
-			out, err := json.Marshal(struct {
-				Username string `json:"username"`
-				Password string `json:"password,omitempty"`
-				Status   string `json:"status"`
-				Metadata string `json:"metadata,omitempty"`
-			}{
-				Username: string(username),
-				Password: string(password),
-				Status:   status.String(),
-				Metadata: string(metadata),
-			})
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				os.Exit(1)
-			}
-			fmt.Println(string(out))
+			report(username, password, result.Status, result.Metadata, matches, err)
+			continue
 		}
+		if bucketURL != "" {
+			// batch queries are answered by the server, not the static export
+			status, metadata, err := client.Query(ctx, username, password)
+			report(username, password, status, metadata, nil, err)
+			continue
+		}
+		batch = append(batch, migp.Credential{Username: username, Password: password})
+		if len(batch) >= batchSize {
+			flush()
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// printResult prints the outcome of a query as a line of JSON
+func printResult(username, password []byte, status migp.BreachStatus, metadata []byte, matches []string, queryErr error) error {
+	result := struct {
+		Username string         `json:"username"`
+		Password string         `json:"password,omitempty"`
+		Status   string         `json:"status,omitempty"`
+		Metadata string         `json:"metadata,omitempty"`
+		Breach   *migp.Metadata `json:"breach,omitempty"`
+		Matches  []string       `json:"matches,omitempty"`
+		Error    string         `json:"error,omitempty"`
+	}{
+		Username: string(username),
+		Password: string(password),
+	}
+	if queryErr != nil {
+		result.Error = queryErr.Error()
+	} else {
+		result.Status = status.String()
+		result.Matches = matches
+		// legacy metadata is printed raw, as before
+		if parsed := migp.ParseMetadata(metadata); parsed != nil && parsed.IsLegacy() {
+			result.Metadata = string(parsed.Raw)
+		} else {
+			result.Breach = parsed
+		}
+	}
+	out, err := json.Marshal(result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
 	}
+	fmt.Println(string(out))
+	return nil
 }
@@ -0,0 +1,157 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// inputHeadSize is the number of leading bytes of an input file hashed to
+// identify it across runs
+const inputHeadSize = 1 << 20
+
+// inputIdentity identifies an input file so that a checkpoint is only ever
+// resumed against the file it was recorded for
+type inputIdentity struct {
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	HeadSHA256 string `json:"headSHA256"`
+}
+
+// identifyInput computes the identity of the input file f, leaving its
+// position unchanged
+func identifyInput(f *os.File) (inputIdentity, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return inputIdentity{}, err
+	}
+	path, err := filepath.Abs(f.Name())
+	if err != nil {
+		return inputIdentity{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, inputHeadSize)); err != nil {
+		return inputIdentity{}, err
+	}
+	return inputIdentity{
+		Path:       path,
+		Size:       info.Size(),
+		HeadSHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// matches reports whether a checkpoint recorded for id can be resumed
+// against the input other. Files that have only grown since the checkpoint
+// was recorded still match.
+func (id inputIdentity) matches(other inputIdentity) bool {
+	return id.Path == other.Path && id.HeadSHA256 == other.HeadSHA256 && other.Size >= id.Size
+}
+
+// ingestCheckpoint is the checkpoint of an ingestion run as recorded in the
+// store
+type ingestCheckpoint struct {
+	Input     inputIdentity  `json:"input"`
+	Epoch     uint32         `json:"epoch"`
+	Phase     int            `json:"phase"`
+	Progress  ingestProgress `json:"progress"`
+	Complete  bool           `json:"complete"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+}
+
+// checkpointKey returns the store metadata key for the checkpoint of the
+// given ingestion phase in the given key epoch
+func checkpointKey(epoch uint32, phase int) string {
+	if epoch == 0 {
+		return fmt.Sprintf("ingest/checkpoint/phase%d", phase)
+	}
+	return fmt.Sprintf("ingest/checkpoint/epoch%d/phase%d", epoch, phase)
+}
+
+// loadCheckpoint returns the checkpoint recorded for the given epoch and
+// phase, or nil if there is none
+func loadCheckpoint(kv store.Store, epoch uint32, phase int) (*ingestCheckpoint, error) {
+	data, err := kv.GetMeta(checkpointKey(epoch, phase))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	cp := new(ingestCheckpoint)
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// saveCheckpoint records the checkpoint in the store
+func saveCheckpoint(kv store.Store, cp *ingestCheckpoint) error {
+	cp.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return kv.PutMeta(checkpointKey(cp.Epoch, cp.Phase), data)
+}
+
+// checkpointEntry returns a store entry without a value that records the
+// checkpoint when appended along with a batch of entries
+func checkpointEntry(cp *ingestCheckpoint) (store.Entry, error) {
+	cp.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return store.Entry{}, err
+	}
+	return store.Entry{Meta: map[string][]byte{checkpointKey(cp.Epoch, cp.Phase): data}}, nil
+}
+
+// resumeCheckpoint returns the checkpoint to resume ingestion of input from,
+// or an error if the recorded checkpoint belongs to a different input
+func resumeCheckpoint(kv store.Store, epoch uint32, phase int, input inputIdentity) (*ingestCheckpoint, error) {
+	cp, err := loadCheckpoint(kv, epoch, phase)
+	if err != nil {
+		return nil, err
+	}
+	if cp == nil {
+		return nil, fmt.Errorf("no checkpoint recorded for phase %d in epoch %d", phase, epoch)
+	}
+	if !cp.Input.matches(input) {
+		return nil, fmt.Errorf("checkpoint was recorded for %s (%d bytes, head %s), not %s", cp.Input.Path, cp.Input.Size, cp.Input.HeadSHA256, input.Path)
+	}
+	if cp.Complete {
+		return nil, errors.New("checkpointed ingestion run already completed")
+	}
+	return cp, nil
+}
+
+// ingestReport is the summary of an ingestion run written at completion
+type ingestReport struct {
+	Input          inputIdentity  `json:"input"`
+	Epoch          uint32         `json:"epoch"`
+	Phase          int            `json:"phase"`
+	Resumed        bool           `json:"resumed"`
+	StartOffset    int64          `json:"startOffset"`
+	Progress       ingestProgress `json:"progress"`
+	Started        time.Time      `json:"started"`
+	Finished       time.Time      `json:"finished"`
+	Duration       string         `json:"duration"`
+	LinesPerSecond float64        `json:"linesPerSecond"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// writeReport writes the report as JSON to path
+func writeReport(path string, report ingestReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
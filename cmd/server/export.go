@@ -0,0 +1,157 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// exportConfigFile is the name of the client configuration file written
+// alongside exported buckets
+const exportConfigFile = "config"
+
+// maxExportEmptyBitSize bounds the bucket ID bit size for which every empty
+// bucket is exported, as one file is written per bucket ID and epoch
+const maxExportEmptyBitSize = 20
+
+// exportStats summarizes a bucket export
+type exportStats struct {
+	Buckets int64
+	Bytes   int64
+	Skipped int64
+}
+
+// runExport implements the export command, which writes every bucket in the
+// store to a directory tree that can be served statically, e.g. from a CDN
+func runExport(args []string) error {
+	var configFile, storeBackend, storePath, outDir string
+	var includeEmpty bool
+
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "Server configuration file")
+	fs.StringVar(&storeBackend, "store", store.BackendPostgres, "storage backend for buckets: memory, file, or postgres")
+	fs.StringVar(&storePath, "store-path", "", "database file for the file backend, or connection string for the postgres backend (default: $DB_CONNECTION_ST)")
+	fs.StringVar(&outDir, "out", "buckets", "directory to write buckets to")
+	fs.BoolVar(&includeEmpty, "empty", false, fmt.Sprintf("also write every empty bucket, so that missing files don't reveal which buckets are empty (bucket ID bit sizes up to %d)", maxExportEmptyBitSize))
+	fs.Parse(args)
+
+	if configFile == "" {
+		return errors.New("export requires the server configuration given with -config")
+	}
+	cfg, err := loadServerConfig(configFile)
+	if err != nil {
+		return err
+	}
+	kv, err := openStore(storeBackend, storePath)
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	s, err := newServer(cfg, kv)
+	if err != nil {
+		return err
+	}
+
+	stats, err := s.export(outDir, includeEmpty)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d buckets (%d bytes) to %s, skipped %d buckets of epochs without a key", stats.Buckets, stats.Bytes, outDir, stats.Skipped)
+	return nil
+}
+
+// export writes each bucket of the epochs the server holds keys for to
+// outDir/<bucket key>, padded as it would be served, and the client
+// configuration for the active epoch to outDir/config. With includeEmpty,
+// every bucket ID without stored entries is written as well, for bucket ID
+// bit sizes up to maxExportEmptyBitSize. Each file is written to a temporary
+// file that replaces it once complete.
+func (s *server) export(outDir string, includeEmpty bool) (exportStats, error) {
+	var stats exportStats
+	bitSize := s.migpServer.Config().BucketIDBitSize
+	if includeEmpty && bitSize > maxExportEmptyBitSize {
+		return stats, fmt.Errorf("exporting every empty bucket is limited to bucket ID bit sizes up to %d, not %d", maxExportEmptyBitSize, bitSize)
+	}
+	epochs := map[uint32]bool{s.migpServer.Epoch(): true}
+	if s.migpServer.Config().PreviousPrivateKey != nil {
+		epochs[s.migpServer.Epoch()-1] = true
+	}
+
+	written := make(map[string]bool)
+	writeBucket := func(key string, contents []byte) error {
+		padded, err := s.migpServer.PadBucket(key, contents)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(outDir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		err = replaceFile(path, 0644, func(w io.Writer) error {
+			_, err := w.Write(padded)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		stats.Buckets++
+		stats.Bytes += int64(len(padded))
+		return nil
+	}
+
+	err := s.kv.ForEach(func(key string, value []byte) error {
+		epoch, _, err := migp.ParseBucketKey(key)
+		if err != nil {
+			return err
+		}
+		if !epochs[epoch] {
+			stats.Skipped++
+			return nil
+		}
+		if includeEmpty {
+			written[key] = true
+		}
+		return writeBucket(key, value)
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if includeEmpty {
+		for epoch := range epochs {
+			for id := uint64(0); id < 1<<uint(bitSize); id++ {
+				key := migp.BucketKey(epoch, migp.BucketIDToHex(uint32(id)))
+				if written[key] {
+					continue
+				}
+				if err := writeBucket(key, nil); err != nil {
+					return stats, err
+				}
+			}
+		}
+	}
+
+	cfg, err := s.activeConfig()
+	if err != nil {
+		return stats, err
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return stats, err
+	}
+	return stats, replaceFile(filepath.Join(outDir, exportConfigFile), 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
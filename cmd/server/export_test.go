@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// TestExport exports the store to a directory, serves it statically and
+// queries it through the OPRF-only endpoint
+func TestExport(t *testing.T) {
+	serverCfg := migp.DefaultServerConfig()
+	serverCfg.BucketIDBitSize = 4
+	serverCfg.Padding = migp.PaddingConfig{Policy: migp.PaddingFixed, Entries: 4}
+	s, err := newServer(serverCfg, store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.insert([]byte("username1"), []byte("password1"), ingestOptions{phaseNum: 1, metadata: []byte("exported")}); err != nil {
+		t.Fatal(err)
+	}
+
+	outDir := t.TempDir()
+	stats, err := s.export(outDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Buckets != 16 {
+		t.Fatalf("want 16 buckets, got %d", stats.Buckets)
+	}
+	data, err := os.ReadFile(filepath.Join(outDir, exportConfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg migp.Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	apiServer := httptest.NewServer(s.handler())
+	defer apiServer.Close()
+	bucketServer := httptest.NewServer(http.FileServer(http.Dir(outDir)))
+	defer bucketServer.Close()
+
+	client, err := migp.NewHTTPClient(cfg, apiServer.URL, migp.WithBucketURL(bucketServer.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		password string
+		status   migp.BreachStatus
+	}{
+		{"password1", migp.InBreach},
+		{"password2", migp.NotInBreach},
+	} {
+		status, metadata, err := client.Query(context.Background(), []byte("username1"), []byte(test.password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.status {
+			t.Errorf("%s: want %s, got %s", test.password, test.status, status)
+		}
+		if status == migp.InBreach && string(metadata) != "exported" {
+			t.Errorf("metadata: want %q, got %q", "exported", metadata)
+		}
+	}
+
+	// the exported bucket matches the bucket served by /evaluate
+	bucketKey := s.migpServer.BucketKey([]byte("username1"))
+	exported, err := os.ReadFile(filepath.Join(outDir, bucketKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.kv.Get(bucketKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, err := s.migpServer.PadBucket(bucketKey, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(exported) != string(served) {
+		t.Error("exported bucket differs from served bucket")
+	}
+
+	// files are readable by the web server, and no temporary files remain
+	for _, name := range []string{exportConfigFile, bucketKey} {
+		info, err := os.Stat(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0644 {
+			t.Errorf("%s: want mode 0644, got %v", name, info.Mode().Perm())
+		}
+	}
+	err = filepath.Walk(outDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.Contains(info.Name(), ".tmp") {
+			t.Errorf("temporary file left behind: %s", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without empty buckets, missing buckets are treated as empty
+	if err := os.RemoveAll(outDir); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = s.export(outDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Buckets != 1 {
+		t.Fatalf("want 1 bucket, got %d", stats.Buckets)
+	}
+	if status, _, err := client.Query(context.Background(), []byte("username2"), []byte("password1")); err != nil || status != migp.NotInBreach {
+		t.Fatalf("missing bucket: want %s, got %s %v", migp.NotInBreach, status, err)
+	}
+}
+
+// TestExportEmptyBitSize checks that exporting every empty bucket is refused
+// for bucket ID bit sizes that would write too many files
+func TestExportEmptyBitSize(t *testing.T) {
+	serverCfg := migp.DefaultServerConfig()
+	serverCfg.BucketIDBitSize = maxExportEmptyBitSize + 1
+	s, err := newServer(serverCfg, store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	if _, err := s.export(outDir, true); err == nil {
+		t.Fatal("expected error exporting empty buckets")
+	}
+	files, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("want nothing written, got %d files", len(files))
+	}
+	if _, err := s.export(outDir, false); err != nil {
+		t.Fatal(err)
+	}
+}
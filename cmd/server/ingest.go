@@ -0,0 +1,329 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// pipelineConfig controls the concurrency and batching of bulk ingestion
+type pipelineConfig struct {
+	workers        int
+	batchSize      int
+	reportInterval time.Duration
+
+	// checkpointEntry, if set, returns an entry recording the progress
+	// committed by a batch, which is appended along with the batch so that
+	// the store never holds entries past the recorded offset
+	checkpointEntry func(ingestProgress) (store.Entry, error)
+
+	// checkpoint, if set, is called after each batch is written with the
+	// progress committed to the store so far
+	checkpoint func(ingestProgress) error
+}
+
+// ingestStats summarizes an ingestion run
+type ingestStats struct {
+	Lines      int64 `json:"lines"`
+	Successes  int64 `json:"successes"`
+	Failures   int64 `json:"failures"`
+	Entries    int64 `json:"entries"`
+	Duplicates int64 `json:"duplicates"`
+}
+
+// ingestProgress records how far into its input an ingestion run has
+// committed. Every line ending at or before Offset has been written to the
+// store and no line after it, and the line counts cover exactly those lines.
+// Entries and Duplicates count the outcome of those writes.
+type ingestProgress struct {
+	Offset int64 `json:"offset"`
+	ingestStats
+}
+
+// ingestJob is a single input line handed to an encryption worker
+type ingestJob struct {
+	seq                int64
+	end                int64
+	malformed          bool
+	username, password []byte
+
+	// metadata is the JSON-encoded structured metadata given on the line,
+	// if any
+	metadata []byte
+}
+
+// ingestResult holds the encrypted entries for a single input line
+type ingestResult struct {
+	seq     int64
+	end     int64
+	entries []store.Entry
+	err     error
+}
+
+var errMalformedLine = errors.New("malformed input line")
+
+// splitLineMetadata splits an input line of the form
+// <username>:<password>[<tab><metadata>] into the credential pair and the
+// optional per-line metadata, a JSON object following the last tab. Lines
+// without a JSON object after their last tab are returned whole, so that
+// passwords may contain tabs.
+func splitLineMetadata(line []byte) ([]byte, []byte) {
+	i := bytes.LastIndexByte(line, '\t')
+	if i < 0 || !bytes.HasPrefix(line[i+1:], []byte("{")) {
+		return line, nil
+	}
+	return line[:i], line[i+1:]
+}
+
+// encryptJob encrypts the bucket entries for an input line, with the line's
+// structured metadata, if any, replacing the metadata in opts
+func (s *server) encryptJob(job ingestJob, opts ingestOptions) ([]store.Entry, error) {
+	if job.metadata != nil {
+		var metadata migp.Metadata
+		if err := json.Unmarshal(job.metadata, &metadata); err != nil {
+			return nil, fmt.Errorf("parsing line metadata: %w", err)
+		}
+		encoded, err := metadata.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		opts.metadata = encoded
+	}
+	return s.encryptEntries(job.username, job.password, opts)
+}
+
+// ingest reads credentials in the format <username>:<password>, optionally
+// followed by a tab and per-line metadata as a JSON object, from r,
+// encrypts them on a pool of workers, and appends the resulting entries to
+// the store in batches grouped by bucket. The reader is assumed to be
+// positioned at start.Offset in the input, and the returned progress
+// continues from start.
+func (s *server) ingest(r io.Reader, opts ingestOptions, cfg pipelineConfig, start ingestProgress) (ingestProgress, error) {
+	if cfg.workers < 1 {
+		cfg.workers = 1
+	}
+	if cfg.batchSize < 1 {
+		cfg.batchSize = 1
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	jobs := make(chan ingestJob, cfg.workers*4)
+	results := make(chan ingestResult, cfg.workers*4)
+
+	// Read input lines, tracking the input offset at the end of each line
+	// so that progress can be committed in terms of input position.
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		offset := start.Offset
+		scanner := bufio.NewScanner(r)
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			advance, token, err := bufio.ScanLines(data, atEOF)
+			offset += int64(advance)
+			return advance, token, err
+		})
+		for seq := int64(0); scanner.Scan(); seq++ {
+			job := ingestJob{seq: seq, end: offset}
+			line, metadata := splitLineMetadata(scanner.Bytes())
+			fields := bytes.SplitN(line, []byte(":"), 2)
+			if len(fields) < 2 {
+				job.malformed = true
+			} else {
+				// copy out of the scanner's buffer before handing off
+				job.username = append([]byte{}, fields[0]...)
+				job.password = append([]byte{}, fields[1]...)
+				if metadata != nil {
+					job.metadata = append([]byte{}, metadata...)
+				}
+			}
+			select {
+			case jobs <- job:
+			case <-done:
+				return
+			}
+		}
+		readErr <- scanner.Err()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				result := ingestResult{seq: job.seq, end: job.end, err: errMalformedLine}
+				if !job.malformed {
+					result.entries, result.err = s.encryptJob(job, opts)
+				}
+				select {
+				case results <- result:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Lines finish out of order, but are batched in input order, so that
+	// each batch commits a contiguous range of lines. Hold finished lines
+	// by sequence number until the lines before them have been batched.
+	progress := start
+	batched := start
+	oversized := make(map[string]bool)
+	finished := make(map[int64]ingestResult)
+	var nextSeq int64
+	var batch []store.Entry
+	stage := func() {
+		for {
+			line, ok := finished[nextSeq]
+			if !ok {
+				return
+			}
+			delete(finished, nextSeq)
+			nextSeq++
+			batched.Offset = line.end
+			batched.Lines++
+			if line.err != nil {
+				batched.Failures++
+			} else {
+				batched.Successes++
+				batch = append(batch, line.entries...)
+			}
+		}
+	}
+
+	flush := func() error {
+		if batched.Lines == progress.Lines {
+			return nil
+		}
+		entries := len(batch)
+		if cfg.checkpointEntry != nil {
+			entry, err := cfg.checkpointEntry(batched)
+			if err != nil {
+				return err
+			}
+			batch = append(batch, entry)
+		}
+		if len(batch) > 0 {
+			// group entries by bucket so each bucket is written once
+			sort.SliceStable(batch, func(i, j int) bool { return batch[i].ID < batch[j].ID })
+			appended, err := s.kv.AppendBatch(batch)
+			if err != nil {
+				return err
+			}
+			batched.Entries += int64(appended)
+			batched.Duplicates += int64(entries - appended)
+			if err := s.checkBucketSizes(batch, oversized); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		progress = batched
+		if cfg.checkpoint != nil {
+			return cfg.checkpoint(progress)
+		}
+		return nil
+	}
+
+	// stats counts lines as they finish, for progress reports only
+	var stats ingestStats
+	began := time.Now()
+	report := func(prefix string) {
+		elapsed := time.Since(began).Seconds()
+		rate := 0.0
+		if elapsed > 0 {
+			rate = float64(stats.Lines) / elapsed
+		}
+		log.Printf("%s: %d lines (%d successes, %d failures), %d entries stored, %d duplicates skipped, %.1f lines/s",
+			prefix, stats.Lines, stats.Successes, stats.Failures, progress.Entries, progress.Duplicates, rate)
+	}
+
+	var ticker <-chan time.Time
+	if cfg.reportInterval > 0 {
+		t := time.NewTicker(cfg.reportInterval)
+		defer t.Stop()
+		ticker = t.C
+	}
+
+	for {
+		var result ingestResult
+		var ok bool
+		select {
+		case result, ok = <-results:
+		case <-ticker:
+			report("Encrypting breach entries")
+			continue
+		}
+		if !ok {
+			break
+		}
+
+		stats.Lines++
+		if result.err != nil {
+			stats.Failures++
+			if result.err != errMalformedLine {
+				log.Printf("Insertion failed: %v", result.err)
+			}
+		} else {
+			stats.Successes++
+		}
+		finished[result.seq] = result
+		stage()
+		if len(batch) >= cfg.batchSize {
+			if err := flush(); err != nil {
+				return progress, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return progress, err
+	}
+	report("Encrypted breach entries")
+	return progress, <-readErr
+}
+
+// checkBucketSizes warns about the buckets written by a batch, sorted by
+// bucket, that hold more entries than the fixed padding size, as queries for
+// them fail. Each bucket is only reported once, and recorded in oversized.
+func (s *server) checkBucketSizes(batch []store.Entry, oversized map[string]bool) error {
+	padding := s.migpServer.Config().Padding
+	if padding.Policy != migp.PaddingFixed {
+		return nil
+	}
+	for i, entry := range batch {
+		if entry.Value == nil || oversized[entry.ID] || (i > 0 && batch[i-1].ID == entry.ID) {
+			continue
+		}
+		contents, err := s.kv.Get(entry.ID)
+		if err != nil {
+			return err
+		}
+		entries, err := migp.SplitBucketEntries(contents)
+		if err != nil {
+			return fmt.Errorf("bucket %s: %w", entry.ID, err)
+		}
+		if err := padding.CheckEntries(len(entries)); err != nil {
+			log.Printf("Warning: bucket %s: %v; queries for it will fail until the padding size is raised", entry.ID, err)
+			oversized[entry.ID] = true
+		}
+	}
+	return nil
+}
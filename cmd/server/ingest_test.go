@@ -0,0 +1,307 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// TestIngest runs the parallel ingestion pipeline and checks that every
+// well-formed credential can be queried afterwards
+func TestIngest(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var input strings.Builder
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(&input, "username%d@example.com:password%d\n", i, i)
+	}
+	input.WriteString("malformed line\n")
+	input.WriteString("username0@example.com:password0\n")
+
+	opts := ingestOptions{phaseNum: 1, metadata: []byte("ingest"), includeUsernameVariant: true}
+	progress, err := s.ingest(strings.NewReader(input.String()), opts, pipelineConfig{workers: 4, batchSize: 3}, ingestProgress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ingestProgress{
+		Offset:      int64(input.Len()),
+		ingestStats: ingestStats{Lines: 8, Successes: 7, Failures: 1, Entries: 12, Duplicates: 2},
+	}
+	if progress != want {
+		t.Fatalf("progress: want %+v, got %+v", want, progress)
+	}
+
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		username, password := []byte(fmt.Sprintf("username%d@example.com", i)), []byte(fmt.Sprintf("password%d", i))
+		request, context, err := client.Request(username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := s.migpServer.HandleRequest(request, s.kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, metadata, err := context.Finalize(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != migp.InBreach || string(metadata) != "ingest" {
+			t.Fatalf("%s: want %s %q, got %s %q", username, migp.InBreach, "ingest", status, metadata)
+		}
+	}
+}
+
+// TestIngestLineMetadata checks that structured metadata given per line
+// replaces the run's raw metadata, and that lines with invalid metadata fail
+func TestIngestLineMetadata(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := "alice@example.com:pass\tword\t{\"breachName\":\"Example\",\"breachDate\":\"2019-01-16\"}\n" +
+		"bob@example.com:hunter2\n" +
+		"carol@example.com:secret\t{\"breachDate\":\"yesterday\"}\n" +
+		"dave@example.com:tab\tpassword\n"
+	opts := ingestOptions{phaseNum: 1, metadata: []byte("legacy")}
+	progress, err := s.ingest(strings.NewReader(input), opts, pipelineConfig{workers: 2, batchSize: 2}, ingestProgress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Successes != 3 || progress.Failures != 1 {
+		t.Fatalf("progress: got %+v", progress)
+	}
+
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username, password string
+		want               migp.Metadata
+	}{
+		{"alice@example.com", "pass\tword", migp.Metadata{BreachName: "Example", BreachDate: time.Date(2019, 1, 16, 0, 0, 0, 0, time.UTC)}},
+		{"bob@example.com", "hunter2", migp.Metadata{Raw: []byte("legacy")}},
+		{"dave@example.com", "tab\tpassword", migp.Metadata{Raw: []byte("legacy")}},
+	}
+	for _, test := range tests {
+		request, context, err := client.Request([]byte(test.username), []byte(test.password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := s.migpServer.HandleRequest(request, s.kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, metadata, err := context.FinalizeMetadata(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != migp.InBreach || !reflect.DeepEqual(&test.want, metadata) {
+			t.Fatalf("%s: want %s %+v, got %s %+v", test.username, migp.InBreach, test.want, status, metadata)
+		}
+	}
+}
+
+// TestIngestResume interrupts an ingestion run after its first checkpoint
+// and checks that resuming picks up the remaining lines
+func TestIngestResume(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var input strings.Builder
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(&input, "username%d@example.com:password%d\n", i, i)
+	}
+	path := filepath.Join(t.TempDir(), "breach.txt")
+	if err := os.WriteFile(path, []byte(input.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts := ingestOptions{phaseNum: 1}
+
+	// stop the first run after its first checkpoint
+	errInterrupted := errors.New("interrupted")
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := pipelineConfig{workers: 1, batchSize: 2}
+	cfg.checkpoint = func(progress ingestProgress) error {
+		identity, err := identifyInput(f)
+		if err != nil {
+			return err
+		}
+		if err := saveCheckpoint(s.kv, &ingestCheckpoint{Input: identity, Phase: 1, Progress: progress}); err != nil {
+			return err
+		}
+		return errInterrupted
+	}
+	if _, err := s.ingest(f, opts, cfg, ingestProgress{}); err != errInterrupted {
+		t.Fatalf("want %v, got %v", errInterrupted, err)
+	}
+	f.Close()
+
+	cp, err := loadCheckpoint(s.kv, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Progress.Lines != 2 || cp.Progress.Offset != int64(len("username0@example.com:password0\nusername1@example.com:password1\n")) {
+		t.Fatalf("checkpoint: got %+v", cp.Progress)
+	}
+
+	// resume from the checkpoint and write a report
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	if err := runIngest(s, f, opts, pipelineConfig{workers: 2, batchSize: 2}, true, reportPath); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report ingestReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Resumed || report.StartOffset != cp.Progress.Offset || report.Progress.Lines != 6 || report.Progress.Entries != 6 || report.Progress.Duplicates != 0 {
+		t.Fatalf("report: got %+v", report)
+	}
+
+	cp, err = loadCheckpoint(s.kv, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.Complete || cp.Progress.Offset != int64(input.Len()) {
+		t.Fatalf("final checkpoint: got %+v", cp)
+	}
+
+	// a completed run cannot be resumed again
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := runIngest(s, f, opts, pipelineConfig{}, true, ""); err == nil {
+		t.Fatal("expected error resuming a completed run")
+	}
+}
+
+// TestIngestResumePhaseTwo stops a phase two run right after its first batch
+// is written, before any further checkpoint, and checks that resuming
+// doesn't encrypt the batch's lines again. Encrypting a line whose variants
+// are stored would add random fallback variants for it.
+func TestIngestResumePhaseTwo(t *testing.T) {
+	kv := store.NewMemoryStore()
+	s, err := newServer(migp.DefaultServerConfig(), kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var input strings.Builder
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(&input, "username%d@example.com:password%d\n", i, i)
+	}
+	path := filepath.Join(t.TempDir(), "breach.txt")
+	if err := os.WriteFile(path, []byte(input.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	const numVariants = 3
+	opts := ingestOptions{phaseNum: 2, numVariants: numVariants}
+
+	errInterrupted := errors.New("interrupted")
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := identifyInput(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := &ingestCheckpoint{Input: identity, Phase: 2}
+	cfg := pipelineConfig{workers: 1, batchSize: 2 * numVariants}
+	cfg.checkpointEntry = func(progress ingestProgress) (store.Entry, error) {
+		cp.Progress = progress
+		return checkpointEntry(cp)
+	}
+	cfg.checkpoint = func(ingestProgress) error { return errInterrupted }
+	if _, err := s.ingest(f, opts, cfg, ingestProgress{}); err != errInterrupted {
+		t.Fatalf("want %v, got %v", errInterrupted, err)
+	}
+	f.Close()
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := runIngest(s, f, opts, pipelineConfig{workers: 2, batchSize: numVariants}, true, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := 0
+	err = kv.ForEach(func(id string, value []byte) error {
+		entries, err := migp.SplitBucketEntries(value)
+		stored += len(entries)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != 4*numVariants {
+		t.Fatalf("stored entries: want %d, got %d", 4*numVariants, stored)
+	}
+}
+
+// TestIngestOversizedBuckets checks that ingestion warns once about each
+// bucket that outgrows the fixed padding size
+func TestIngestOversizedBuckets(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.Padding = migp.PaddingConfig{Policy: migp.PaddingFixed, Entries: 1}
+	s, err := newServer(cfg, store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "alice@example.com:password1\nalice@example.com:password2\nalice@example.com:password3\nbob@example.com:password1\n"
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	opts := ingestOptions{phaseNum: 1}
+	if _, err := s.ingest(strings.NewReader(input), opts, pipelineConfig{workers: 1, batchSize: 1}, ingestProgress{}); err != nil {
+		t.Fatal(err)
+	}
+	alice := s.migpServer.BucketKey([]byte("alice@example.com"))
+	if n := strings.Count(logs.String(), "bucket "+alice+":"); n != 1 {
+		t.Errorf("want one warning for bucket %s, got %d:\n%s", alice, n, logs.String())
+	}
+	if n := strings.Count(logs.String(), migp.ErrBucketTooLarge.Error()); n != 1 {
+		t.Errorf("want one oversized bucket warning, got %d:\n%s", n, logs.String())
+	}
+}
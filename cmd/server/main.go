@@ -8,34 +8,69 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
 )
 
+// commands maps subcommand names to their implementations, which parse their
+// own flags from the remaining arguments
+var commands = map[string]func(args []string) error{
+	"export":   runExport,
+	"snapshot": runSnapshot,
+	"migrate":  runMigrate,
+	"rebucket": runRebucket,
+	"remove":   runRemove,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 
-	var configFile, inputFilename, metadata, listenAddr string
-	var dumpConfig, includeUsernameVariant, phaseOne, phaseTwo, startServer,  usePagPassGPT bool
-	var numVariants, phaseNum int
+	var configFile, inputFilename, metadata, listenAddr, storeBackend, storePath, reportPath string
+	var dumpConfig, includeUsernameVariant, phaseOne, phaseTwo, startServer, usePagPassGPT, resume, reencrypt, activateEpoch, recordBucketHash bool
+	var numVariants, phaseNum, workers, batchSize int
+	var reportInterval time.Duration
 
 	flag.StringVar(&configFile, "config", "", "Server configuration file")
 	flag.StringVar(&listenAddr, "listen", "localhost:8080", "Server listen address")
+	flag.StringVar(&storeBackend, "store", store.BackendPostgres, "storage backend for buckets: memory, file, or postgres")
+	flag.StringVar(&storePath, "store-path", "", "database file for the file backend, or connection string for the postgres backend (default: $DB_CONNECTION_ST)")
 	flag.BoolVar(&dumpConfig, "dump-config", false, "Dump the server configuration to stdout and exit")
-	flag.StringVar(&inputFilename, "infile", "-", "input file of credentials to insert in the format <username>:<password> ('-' for stdin)")
-	flag.StringVar(&metadata, "metadata", "", "optional metadata string to store alongside breach entries")
+	flag.StringVar(&inputFilename, "infile", "-", "input file of credentials to insert in the format <username>:<password>[<tab><json metadata>] ('-' for stdin)")
+	flag.StringVar(&metadata, "metadata", "", "optional raw metadata string to store alongside breach entries without per-line metadata")
 	flag.IntVar(&numVariants, "num-variants", 9, "number of password variants to include")
 	flag.BoolVar(&includeUsernameVariant, "username-variant", true, "include a username-only variant")
 	flag.BoolVar(&phaseOne, "phaseone", false, "inserts primary list of username-password")
 	flag.BoolVar(&phaseTwo, "phasetwo", false, "inserts password variants from the primary list")
 	flag.BoolVar(&startServer, "start-server", false, "starts local server")
 	flag.BoolVar(&usePagPassGPT, "use-pagpassgpt", false, "generate password variants using PagPassGPT")
+	flag.IntVar(&workers, "workers", runtime.NumCPU(), "number of concurrent workers encrypting breach entries")
+	flag.IntVar(&batchSize, "batch-size", 1000, "number of encrypted entries to buffer before writing them to the store")
+	flag.DurationVar(&reportInterval, "report-interval", 10*time.Second, "interval between ingestion progress reports (0 to disable)")
+	flag.BoolVar(&resume, "resume", false, "resume ingestion of -infile from the checkpoint recorded in the store")
+	flag.StringVar(&reportPath, "report", "", "write a JSON summary of the ingestion run to this file")
+	flag.BoolVar(&reencrypt, "reencrypt", false, "ingest -infile under the current key epoch in the background while serving queries")
+	flag.BoolVar(&activateEpoch, "activate-epoch", false, "advertise the current key epoch to clients once ingestion completes")
+	flag.BoolVar(&recordBucketHash, "record-bucket-hash", false, "record the full bucket hash of each entry, so that the dataset can be rebucketed")
 	flag.Parse()
 
 	phaseNum = 0
@@ -46,19 +81,13 @@ func main() {
 	} else if phaseTwo {
 		phaseNum = 2
 	}
+	if reencrypt && (phaseNum == 0 || !startServer) {
+		log.Fatal("Wrong usage. `reencrypt` requires `start-server` and either `phaseone` or `phasetwo`.")
+	}
 
-	var cfg migp.ServerConfig
-	if configFile != "" {
-		data, err := os.ReadFile(configFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = json.Unmarshal(data, &cfg)
-		if err != nil {
-			log.Fatal(err)
-		}
-	} else {
-		cfg = migp.DefaultServerConfig()
+	cfg, err := loadServerConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	if dumpConfig {
@@ -73,10 +102,17 @@ func main() {
 		return
 	}
 
-	s, err := newServer(cfg)
+	kv, err := openStore(storeBackend, storePath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	s, err := newServer(cfg, kv)
+	if err != nil {
+		kv.Close()
+		log.Fatal(err)
+	}
+	// a reload may have replaced kv
+	defer s.close()
 
 	inputFile := os.Stdin
 	if inputFilename != "-" {
@@ -90,32 +126,269 @@ func main() {
 		log.Printf("Please make sure you have access to PagPassGPT's model and `generate_pw_variant.py` script.")
 	}
 
-	successCount, failureCount := 0, 0
 	if phaseNum != 0 {
-		log.Printf("Encrypting breach entries: %d successes, %d failures", successCount, failureCount)
-		scanner := bufio.NewScanner(inputFile)
-		for scanner.Scan() {
-			fields := bytes.SplitN(scanner.Bytes(), []byte(":"), 2)
-			if len(fields) < 2 {
-				failureCount += 1
-				continue
+		opts := ingestOptions{
+			phaseNum:               phaseNum,
+			metadata:               []byte(metadata),
+			numVariants:            numVariants,
+			includeUsernameVariant: includeUsernameVariant,
+			usePagPassGPT:          usePagPassGPT,
+			recordBucketHash:       recordBucketHash,
+		}
+		cfg := pipelineConfig{
+			workers:        workers,
+			batchSize:      batchSize,
+			reportInterval: reportInterval,
+		}
+		ingest := func() error {
+			if err := runIngest(s, inputFile, opts, cfg, resume, reportPath); err != nil {
+				return err
 			}
-			username, password := fields[0], fields[1]
-
-			if err := s.insert(username, password, []byte(metadata), numVariants, includeUsernameVariant, phaseNum, usePagPassGPT); err != nil {
-				failureCount += 1
-				log.Printf("Insertion failed: %v", err)
-				continue
+			if activateEpoch {
+				log.Printf("Activating key epoch %d", s.migpServer.Epoch())
+				return s.activateEpoch()
 			}
-			successCount += 1
+			return nil
+		}
+		if reencrypt {
+			// Buckets for the previous epoch keep answering queries
+			// while the current epoch's buckets are written.
+			go func() {
+				if err := ingest(); err != nil {
+					log.Printf("Re-encryption failed: %v", err)
+				}
+			}()
+		} else if err := ingest(); err != nil {
+			log.Fatal(err)
 		}
-		log.Printf("\rEncrypting breach entries: %d successes, %d failures", successCount, failureCount)
 	} else {
 		log.Printf("\n Please select either `phaseone` or `phasetwo` to encrypt breach entries.")
 	}
 
 	if startServer {
+		if configFile != "" && !reencrypt {
+			hangup := make(chan os.Signal, 1)
+			signal.Notify(hangup, syscall.SIGHUP)
+			go reloadOnHangup(s, configFile, storeBackend, storePath, hangup, func(err error) {
+				if err != nil {
+					log.Printf("Reload failed: %v", err)
+				} else {
+					log.Printf("Reloaded configuration from %s", configFile)
+				}
+			})
+		}
 		log.Printf("\nStarting MIGP server")
-		log.Fatal(http.ListenAndServe(listenAddr, s.handler()))
+		err := http.ListenAndServe(listenAddr, s.handler())
+		// log.Fatal skips deferred calls
+		s.close()
+		log.Fatal(err)
+	}
+}
+
+// runIngest ingests credentials from input. If input is a regular file,
+// progress is checkpointed in the store with each batch, in the same write as
+// the batch's entries, and with resume set ingestion continues from the last
+// checkpoint instead of the start of the file. If reportPath is set, a
+// summary of the run is written to it.
+func runIngest(s *server, input *os.File, opts ingestOptions, cfg pipelineConfig, resume bool, reportPath string) error {
+	epoch := s.migpServer.Epoch()
+	info, err := input.Stat()
+	if err != nil {
+		return err
+	}
+
+	var cp *ingestCheckpoint
+	if info.Mode().IsRegular() {
+		identity, err := identifyInput(input)
+		if err != nil {
+			return err
+		}
+		if resume {
+			if cp, err = resumeCheckpoint(s.kv, epoch, opts.phaseNum, identity); err != nil {
+				return err
+			}
+			if _, err := input.Seek(cp.Progress.Offset, io.SeekStart); err != nil {
+				return err
+			}
+			log.Printf("Resuming ingestion of %s at offset %d after %d lines", identity.Path, cp.Progress.Offset, cp.Progress.Lines)
+		} else {
+			cp = &ingestCheckpoint{Input: identity, Epoch: epoch, Phase: opts.phaseNum}
+		}
+		cfg.checkpointEntry = func(progress ingestProgress) (store.Entry, error) {
+			cp.Progress = progress
+			return checkpointEntry(cp)
+		}
+		cfg.checkpoint = func(progress ingestProgress) error {
+			// the entry counts of the batch are only known once written
+			cp.Progress = progress
+			return saveCheckpoint(s.kv, cp)
+		}
+	} else if resume {
+		return errors.New("resuming requires a regular input file given with -infile")
+	}
+
+	var start ingestProgress
+	if cp != nil {
+		start = cp.Progress
+	}
+	began := time.Now()
+	progress, err := s.ingest(input, opts, cfg, start)
+	if cp != nil && err == nil {
+		cp.Progress = progress
+		cp.Complete = true
+		err = saveCheckpoint(s.kv, cp)
+	}
+
+	if reportPath != "" {
+		finished := time.Now()
+		report := ingestReport{
+			Epoch:       epoch,
+			Phase:       opts.phaseNum,
+			Resumed:     resume,
+			StartOffset: start.Offset,
+			Progress:    progress,
+			Started:     began.UTC(),
+			Finished:    finished.UTC(),
+			Duration:    finished.Sub(began).String(),
+		}
+		if cp != nil {
+			report.Input = cp.Input
+		}
+		if elapsed := finished.Sub(began).Seconds(); elapsed > 0 {
+			report.LinesPerSecond = float64(progress.Lines-start.Lines) / elapsed
+		}
+		if err != nil {
+			report.Error = err.Error()
+		}
+		if reportErr := writeReport(reportPath, report); reportErr != nil {
+			log.Printf("Writing report failed: %v", reportErr)
+		}
+	}
+	return err
+}
+
+// loadServerConfig reads the server configuration from configFile, or
+// generates a default configuration with a fresh key if configFile is empty
+func loadServerConfig(configFile string) (migp.ServerConfig, error) {
+	if configFile == "" {
+		return migp.DefaultServerConfig(), nil
+	}
+	var cfg migp.ServerConfig
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// openStore opens the requested storage backend, falling back to the
+// DB_CONNECTION_ST environment variable for the PostgreSQL connection string.
+func openStore(backend, path string) (store.Store, error) {
+	return store.Open(backend, resolveStorePath(backend, path))
+}
+
+// resolveStorePath returns the path or connection string to open the
+// requested storage backend with, filling in defaults for an empty path
+func resolveStorePath(backend, path string) string {
+	switch backend {
+	case store.BackendPostgres:
+		if path == "" {
+			path = os.Getenv("DB_CONNECTION_ST")
+		}
+		if path == "" {
+			log.Println("DB_CONNECTION_ST environment variable not set. Using default localhost connection string.")
+			path = "user=cs-db password=hacker dbname=cs-db sslmode=disable host=localhost"
+		}
+		log.Printf("Using database connection string: %s", path)
+	case store.BackendFile:
+		if path == "" {
+			path = "migp.db"
+		}
+		log.Printf("Using database file: %s", path)
+	}
+	return path
+}
+
+// replaceFile writes a file with write and atomically replaces path with it,
+// so that readers of path never see a partially written file. The file gets
+// the permissions perm.
+func replaceFile(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// errReloadMemory is returned when reloading a server backed by the memory
+// store, whose entries would be lost
+var errReloadMemory = errors.New("the memory backend can't be reloaded without losing its entries")
+
+// reloadOnHangup reloads the server configuration from configFile and reopens
+// the store for each signal received on hangup until it is closed, e.g. to
+// switch to a rebucketed dataset, and reports the outcome to reloaded. The
+// file backend is only reopened once its path refers to a different file,
+// since the server holds a lock on the open one.
+func reloadOnHangup(s *server, configFile, storeBackend, storePath string, hangup <-chan os.Signal, reloaded func(error)) {
+	storePath = resolveStorePath(storeBackend, storePath)
+	var current os.FileInfo
+	if storeBackend == store.BackendFile {
+		var err error
+		if current, err = os.Stat(storePath); err != nil {
+			reloaded(err)
+		}
+	}
+	for range hangup {
+		reloaded(s.reloadFrom(configFile, storeBackend, storePath, &current))
+	}
+}
+
+// reloadFrom reloads the server configuration from configFile and reopens the
+// store, unless current is the file backend's open file and storePath still
+// refers to it. It updates current to the file that is open afterwards.
+func (s *server) reloadFrom(configFile, storeBackend, storePath string, current *os.FileInfo) error {
+	if storeBackend == store.BackendMemory {
+		return errReloadMemory
+	}
+	cfg, err := loadServerConfig(configFile)
+	if err != nil {
+		return err
+	}
+	var file os.FileInfo
+	if storeBackend == store.BackendFile {
+		if file, err = os.Stat(storePath); err != nil {
+			return err
+		}
+	}
+	var kv store.Store
+	if file == nil || *current == nil || !os.SameFile(file, *current) {
+		if kv, err = store.Open(storeBackend, storePath); err != nil {
+			return err
+		}
+	}
+	old, err := s.reload(cfg, kv)
+	if err != nil {
+		if kv != nil {
+			kv.Close()
+		}
+		return err
+	}
+	if old != nil {
+		old.Close()
 	}
+	*current = file
+	return nil
 }
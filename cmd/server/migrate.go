@@ -0,0 +1,290 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// migrateBatchSize is the number of entries appended to the destination store
+// at once
+const migrateBatchSize = 1000
+
+// errDestinationNotEmpty is returned when migrating into a store that already
+// holds buckets
+var errDestinationNotEmpty = errors.New("destination store is not empty")
+
+// bucketSource is a source of buckets to migrate, such as a store or a
+// snapshot
+type bucketSource interface {
+	ForEach(fn func(id string, value []byte) error) error
+}
+
+// metaSource is a bucket source that also holds metadata to migrate
+type metaSource interface {
+	ForEachMeta(fn func(key string, value []byte) error) error
+}
+
+// migrateStats summarizes a migration. Skipped counts source entries that
+// were not copied because they repeat an entry of the same bucket, or one
+// the destination already holds in another bucket. NoMeta is set when the
+// source, such as a snapshot, cannot hold metadata.
+type migrateStats struct {
+	Buckets int64
+	Entries int64
+	Skipped int64
+	Bytes   int64
+	Meta    int64
+	NoMeta  bool
+}
+
+// runMigrate implements the migrate command, which copies every bucket and
+// metadata value from a source store or snapshot to an empty destination
+// store
+func runMigrate(args []string) error {
+	var fromBackend, fromPath, fromSnapshot, toBackend, toPath string
+	var partitions int
+	var reportInterval time.Duration
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.StringVar(&fromBackend, "from", store.BackendPostgres, "storage backend to migrate from: memory, file, or postgres")
+	fs.StringVar(&fromPath, "from-path", "", "database file or connection string of the source store (default: as for -store-path)")
+	fs.StringVar(&fromSnapshot, "from-snapshot", "", "migrate from this snapshot file instead of a source store")
+	fs.StringVar(&toBackend, "to", store.BackendFile, "storage backend to migrate to: memory, file, or postgres")
+	fs.StringVar(&toPath, "to-path", "", "database file or connection string of the destination store (default: as for -store-path)")
+	fs.IntVar(&partitions, "partitions", store.DefaultPostgresPartitions, "number of hash partitions of the bucket table when migrating to postgres")
+	fs.DurationVar(&reportInterval, "report-interval", 10*time.Second, "interval between migration progress reports (0 to disable)")
+	fs.Parse(args)
+
+	toPath = resolveStorePath(toBackend, toPath)
+	var src bucketSource
+	if fromSnapshot != "" {
+		snapshot, err := migp.OpenSnapshot(fromSnapshot)
+		if err != nil {
+			return err
+		}
+		defer snapshot.Close()
+		src = snapshot
+	} else {
+		fromPath = resolveStorePath(fromBackend, fromPath)
+		if fromBackend == toBackend && fromPath == toPath && fromBackend != store.BackendMemory {
+			return errors.New("source and destination store are the same")
+		}
+		kv, err := store.Open(fromBackend, fromPath)
+		if err != nil {
+			return err
+		}
+		defer kv.Close()
+		src = kv
+	}
+
+	var dst store.Store
+	var err error
+	if toBackend == store.BackendPostgres {
+		dst, err = store.OpenPostgresStoreWithPartitions(toPath, partitions)
+	} else {
+		dst, err = store.Open(toBackend, toPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	stats, err := migrate(src, dst, reportInterval)
+	if err != nil {
+		return err
+	}
+	if stats.NoMeta {
+		log.Printf("Migrated %d buckets (%d entries, %d bytes) and 0 metadata values from a snapshot, skipping %d duplicate entries", stats.Buckets, stats.Entries, stats.Bytes, stats.Skipped)
+		return nil
+	}
+	log.Printf("Migrated %d buckets (%d entries, %d bytes) and %d metadata values, skipping %d duplicate entries", stats.Buckets, stats.Entries, stats.Bytes, stats.Meta, stats.Skipped)
+	return nil
+}
+
+// migrate copies every bucket from src to the empty store dst, followed by
+// the metadata if src can hold any. A source without metadata, such as a
+// snapshot, is migrated with a warning, since the destination then lacks the
+// bucket hashes that rebucketing needs and any ingest checkpoints. Entries are appended rather than copied
+// byte for byte, so that dst builds its own shadow index and drops repeated
+// entries, and each bucket is read back and checked against its source.
+func migrate(src bucketSource, dst store.Store, reportInterval time.Duration) (migrateStats, error) {
+	var stats migrateStats
+	err := dst.ForEach(func(id string, value []byte) error {
+		return errDestinationNotEmpty
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	var batch []store.Entry
+	var pendingKeys []string
+	pending := make(map[string][][]byte)
+	flush := func() error {
+		appended, err := dst.AppendBatch(batch)
+		if err != nil {
+			return err
+		}
+		// the store skips entries it already holds in another bucket, so
+		// every entry missing from a bucket must be one of those
+		skipped := int64(len(batch) - appended)
+		var missing int64
+		for _, key := range pendingKeys {
+			contents, err := dst.Get(key)
+			if err != nil {
+				return err
+			}
+			n, err := verifyMigratedBucket(dst, key, pending[key], contents)
+			if err != nil {
+				return err
+			}
+			missing += n
+			stats.Bytes += int64(len(contents))
+		}
+		if missing != skipped {
+			return fmt.Errorf("%d entries skipped by the destination, but %d missing from their buckets", skipped, missing)
+		}
+		stats.Buckets += int64(len(pendingKeys))
+		stats.Entries += int64(appended)
+		stats.Skipped += skipped
+		batch, pendingKeys = batch[:0], pendingKeys[:0]
+		pending = make(map[string][][]byte)
+		return nil
+	}
+
+	var ticker <-chan time.Time
+	if reportInterval > 0 {
+		t := time.NewTicker(reportInterval)
+		defer t.Stop()
+		ticker = t.C
+	}
+
+	err = src.ForEach(func(id string, value []byte) error {
+		entries, err := migp.SplitBucketEntries(value)
+		if err != nil {
+			return fmt.Errorf("bucket %s: %w", id, err)
+		}
+		if len(entries) == 0 {
+			// an empty bucket reads the same as a missing one
+			return nil
+		}
+		unique := uniqueEntries(entries)
+		stats.Skipped += int64(len(entries) - len(unique))
+		for _, entry := range unique {
+			batch = append(batch, store.Entry{ID: id, Value: entry})
+		}
+		pendingKeys = append(pendingKeys, id)
+		pending[id] = unique
+
+		select {
+		case <-ticker:
+			log.Printf("Migrating buckets: %d buckets (%d entries) verified", stats.Buckets, stats.Entries)
+		default:
+		}
+		if len(batch) >= migrateBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := flush(); err != nil {
+		return stats, err
+	}
+
+	meta, ok := src.(metaSource)
+	if !ok {
+		stats.NoMeta = true
+		log.Printf("Warning: the source holds no metadata, so no bucket hashes or ingest checkpoints are migrated; the destination cannot be rebucketed and ingests into it cannot resume")
+		return stats, nil
+	}
+	err = meta.ForEachMeta(func(key string, value []byte) error {
+		stats.Meta++
+		return dst.PutMeta(key, value)
+	})
+	return stats, err
+}
+
+// uniqueEntries returns entries without repeats, in their original order
+func uniqueEntries(entries [][]byte) [][]byte {
+	seen := make(map[string]bool, len(entries))
+	unique := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		if !seen[string(entry)] {
+			seen[string(entry)] = true
+			unique = append(unique, entry)
+		}
+	}
+	return unique
+}
+
+// verifyMigratedBucket checks the migrated contents of bucket key against
+// the unique entries of its source bucket. Source entries may only be missing
+// if dst holds them in another bucket. It returns the number of missing
+// entries.
+func verifyMigratedBucket(dst store.Store, key string, source [][]byte, contents []byte) (int64, error) {
+	entries, err := migp.SplitBucketEntries(contents)
+	if err != nil {
+		return 0, fmt.Errorf("bucket %s: %w", key, err)
+	}
+	if len(entries) == len(source) {
+		if bucketChecksum(entries) != bucketChecksum(source) {
+			return 0, fmt.Errorf("bucket %s: checksum mismatch after migration", key)
+		}
+		return 0, nil
+	}
+
+	migrated := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		migrated[string(entry)] = true
+	}
+	var missing int64
+	for _, entry := range source {
+		if migrated[string(entry)] {
+			delete(migrated, string(entry))
+			continue
+		}
+		unique, err := dst.IsUnique(entry)
+		if err != nil {
+			return 0, err
+		}
+		if unique {
+			return 0, fmt.Errorf("bucket %s: entry lost in migration", key)
+		}
+		missing++
+	}
+	if len(migrated) != 0 {
+		return 0, fmt.Errorf("bucket %s: %d unexpected entries after migration", key, len(migrated))
+	}
+	return missing, nil
+}
+
+// bucketChecksum returns a checksum of the entries in a bucket. It does not
+// depend on the order of the entries, which backends may append a batch in
+// any order.
+func bucketChecksum(entries [][]byte) [sha256.Size]byte {
+	sorted := append([][]byte{}, entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	hash := sha256.New()
+	for _, entry := range sorted {
+		// entries are self-delimiting, so no length prefix is needed
+		hash.Write(entry)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
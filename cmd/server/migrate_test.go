@@ -0,0 +1,154 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// TestMigrate migrates buckets and metadata from a store, and buckets from a
+// snapshot, to new stores that answer queries as the source does
+func TestMigrate(t *testing.T) {
+	src := store.NewMemoryStore()
+	s, err := newServer(migp.DefaultServerConfig(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"username1", "username2", "username3"} {
+		if err := s.insert([]byte(username), []byte("password1"), ingestOptions{phaseNum: 1, metadata: []byte(username)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.PutMeta("test/key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	snapshotPath := filepath.Join(t.TempDir(), "migp.snapshot")
+	if err := s.writeSnapshot(snapshotPath); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := migp.OpenSnapshot(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+
+	for name, source := range map[string]bucketSource{"store": src, "snapshot": snapshot} {
+		dst, err := store.OpenFileStore(filepath.Join(t.TempDir(), "migp.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		stats, err := migrate(source, dst, 0)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		warned := strings.Contains(logs.String(), "Warning: the source holds no metadata")
+		if stats.NoMeta != (name == "snapshot") || warned != stats.NoMeta {
+			t.Errorf("%s: want a metadata warning only for snapshots, got NoMeta %v and logs %q", name, stats.NoMeta, logs.String())
+		}
+		if stats.Buckets != 3 || stats.Entries != 3 {
+			t.Errorf("%s: want 3 buckets with 3 entries, got %+v", name, stats)
+		}
+		err = src.ForEach(func(id string, value []byte) error {
+			migrated, err := dst.Get(id)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(migrated, value) {
+				t.Errorf("%s: bucket %s differs after migration", name, id)
+			}
+			entries, err := migp.SplitBucketEntries(value)
+			if err != nil {
+				return err
+			}
+			unique, err := dst.IsUnique(entries[0])
+			if err != nil {
+				return err
+			}
+			if unique {
+				t.Errorf("%s: entry of bucket %s missing from shadow index", name, id)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := dst.GetMeta("test/key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "store" && (stats.Meta != 1 || !bytes.Equal(value, []byte("value"))) {
+			t.Errorf("%s: metadata not migrated: %d values, got %q", name, stats.Meta, value)
+		}
+
+		if _, err := migrate(source, dst, 0); !errors.Is(err, errDestinationNotEmpty) {
+			t.Errorf("%s: want %v, got %v", name, errDestinationNotEmpty, err)
+		}
+	}
+}
+
+func TestMigrateMalformedBucket(t *testing.T) {
+	src := store.NewMemoryStore()
+	if err := src.Put("00000001", []byte("not a bucket")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrate(src, store.NewMemoryStore(), 0); err == nil {
+		t.Fatal("expected error migrating malformed bucket")
+	}
+}
+
+// TestMigrateDuplicates migrates buckets holding repeated entries, within a
+// bucket and across buckets, which are skipped and reported
+func TestMigrateDuplicates(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.encryptEntries([]byte("username1"), []byte("password1"), ingestOptions{phaseNum: 1, includeUsernameVariant: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := entries[0].Value, entries[1].Value
+	src := store.NewMemoryStore()
+	if err := src.Put("00000001", bytes.Join([][]byte{first, second, first}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Put("00000002", second); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := store.OpenFileStore(filepath.Join(t.TempDir(), "migp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	stats, err := migrate(src, dst, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 2 || stats.Skipped != 2 {
+		t.Errorf("want 2 entries and 2 skipped, got %+v", stats)
+	}
+	value, err := dst.Get("00000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value) != len(first)+len(second) || !bytes.Contains(value, first) || !bytes.Contains(value, second) {
+		t.Errorf("bucket 00000001: want each entry once, got %d bytes", len(value))
+	}
+}
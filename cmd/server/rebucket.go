@@ -0,0 +1,233 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// errBucketIDBound is returned when rebucketing a dataset whose entries are
+// bound to their bucket ID
+var errBucketIDBound = errors.New("bucket IDs are bound into the OPRF evaluation, so entries must be re-ingested to change the bucket ID bit size")
+
+// bucketHashKey returns the store metadata key recording the bucket hash of
+// an entry. Entries are identified by digest to keep keys short.
+func bucketHashKey(entry []byte) string {
+	digest := sha256.Sum256(entry)
+	return "bucket-hash/" + hex.EncodeToString(digest[:])
+}
+
+// rebucketStats summarizes a rebucketing run
+type rebucketStats struct {
+	SourceBuckets int64
+	Buckets       int64
+	Entries       int64
+}
+
+// runRebucket implements the rebucket command, which regroups the entries of
+// a store into buckets for a new bucket ID bit size in an empty destination
+// store, and then writes the server configuration for the new bit size
+func runRebucket(args []string) error {
+	var configFile, outConfig, storeBackend, storePath, toBackend, toPath string
+	var bitSize, partitions int
+	var reportInterval time.Duration
+
+	fs := flag.NewFlagSet("rebucket", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "Server configuration file")
+	fs.StringVar(&outConfig, "out-config", "", "file to write the server configuration for the new bit size to (default: replace -config)")
+	fs.StringVar(&storeBackend, "store", store.BackendPostgres, "storage backend to read buckets from: memory, file, or postgres")
+	fs.StringVar(&storePath, "store-path", "", "database file for the file backend, or connection string for the postgres backend (default: $DB_CONNECTION_ST)")
+	fs.StringVar(&toBackend, "to", store.BackendFile, "storage backend to write the rebucketed buckets to: memory, file, or postgres")
+	fs.StringVar(&toPath, "to-path", "", "database file or connection string of the destination store (default: as for -store-path)")
+	fs.IntVar(&bitSize, "bits", -1, "new bucket ID bit size")
+	fs.IntVar(&partitions, "partitions", store.DefaultPostgresPartitions, "number of hash partitions of the bucket table when writing to postgres")
+	fs.DurationVar(&reportInterval, "report-interval", 10*time.Second, "interval between progress reports (0 to disable)")
+	fs.Parse(args)
+
+	if configFile == "" {
+		return errors.New("rebucket requires the server configuration given with -config")
+	}
+	if outConfig == "" {
+		outConfig = configFile
+	}
+	cfg, err := loadServerConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	storePath = resolveStorePath(storeBackend, storePath)
+	toPath = resolveStorePath(toBackend, toPath)
+	if storeBackend == toBackend && storePath == toPath && storeBackend != store.BackendMemory {
+		return errors.New("source and destination store are the same")
+	}
+	src, err := store.Open(storeBackend, storePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	var dst store.Store
+	if toBackend == store.BackendPostgres {
+		dst, err = store.OpenPostgresStoreWithPartitions(toPath, partitions)
+	} else {
+		dst, err = store.Open(toBackend, toPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	newCfg, stats, err := rebucket(src, dst, cfg, bitSize, reportInterval)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rebucketed %d entries from %d buckets into %d buckets of %d-bit bucket IDs", stats.Entries, stats.SourceBuckets, stats.Buckets, bitSize)
+
+	// the configuration only changes once every bucket is in place
+	err = replaceFile(outConfig, 0600, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(&newCfg)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Wrote server configuration for %d-bit bucket IDs to %s", bitSize, outConfig)
+	return nil
+}
+
+// rebucket regroups the entries of every bucket in src into buckets for
+// bitSize-bit bucket IDs in the empty store dst, using the bucket hash
+// recorded for each entry at ingestion, and copies the metadata of src. It
+// returns the server configuration cfg with the new bit size, or an error if
+// a new bucket couldn't be served under the configured padding.
+func rebucket(src, dst store.Store, cfg migp.ServerConfig, bitSize int, reportInterval time.Duration) (migp.ServerConfig, rebucketStats, error) {
+	var stats rebucketStats
+	if bitSize < 0 || bitSize > 32 {
+		return cfg, stats, fmt.Errorf("bucket ID bit size out of range: %d", bitSize)
+	}
+	if cfg.PublicInput&migp.PublicInputBucketID != 0 {
+		return cfg, stats, errBucketIDBound
+	}
+	err := dst.ForEach(func(id string, value []byte) error {
+		return errDestinationNotEmpty
+	})
+	if err != nil {
+		return cfg, stats, err
+	}
+
+	var batch []store.Entry
+	flush := func() error {
+		sort.SliceStable(batch, func(i, j int) bool { return batch[i].ID < batch[j].ID })
+		appended, err := dst.AppendBatch(batch)
+		if err != nil {
+			return err
+		}
+		if appended != len(batch) {
+			return fmt.Errorf("%d of %d entries were already in the destination", len(batch)-appended, len(batch))
+		}
+		stats.Entries += int64(appended)
+		batch = batch[:0]
+		return nil
+	}
+
+	var ticker <-chan time.Time
+	if reportInterval > 0 {
+		t := time.NewTicker(reportInterval)
+		defer t.Stop()
+		ticker = t.C
+	}
+
+	err = src.ForEach(func(id string, value []byte) error {
+		epoch, _, err := migp.ParseBucketKey(id)
+		if err != nil {
+			return err
+		}
+		entries, err := migp.SplitBucketEntries(value)
+		if err != nil {
+			return fmt.Errorf("bucket %s: %w", id, err)
+		}
+		for _, entry := range entries {
+			bucketHash, err := src.GetMeta(bucketHashKey(entry))
+			if err != nil {
+				return err
+			}
+			if len(bucketHash) < 4 {
+				return fmt.Errorf("bucket %s: entry without a recorded bucket hash, ingest with -record-bucket-hash to rebucket", id)
+			}
+			key := migp.BucketKey(epoch, migp.BucketIDToHex(migp.BucketHashToID(bucketHash, bitSize)))
+			batch = append(batch, store.Entry{ID: key, Value: entry})
+		}
+		stats.SourceBuckets++
+
+		select {
+		case <-ticker:
+			log.Printf("Rebucketing: %d buckets read, %d entries written", stats.SourceBuckets, stats.Entries)
+		default:
+		}
+		if len(batch) >= migrateBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return cfg, stats, err
+	}
+	if err := flush(); err != nil {
+		return cfg, stats, err
+	}
+	if err := src.ForEachMeta(dst.PutMeta); err != nil {
+		return cfg, stats, err
+	}
+
+	// every entry must have landed, and only in the bucket its hash maps to
+	var entries int64
+	err = dst.ForEach(func(id string, value []byte) error {
+		bucketEntries, err := migp.SplitBucketEntries(value)
+		if err != nil {
+			return fmt.Errorf("bucket %s: %w", id, err)
+		}
+		epoch, _, err := migp.ParseBucketKey(id)
+		if err != nil {
+			return err
+		}
+		for _, entry := range bucketEntries {
+			bucketHash, err := dst.GetMeta(bucketHashKey(entry))
+			if err != nil {
+				return err
+			}
+			if len(bucketHash) < 4 {
+				return fmt.Errorf("bucket %s: bucket hash missing after rebucketing", id)
+			}
+			if migp.BucketKey(epoch, migp.BucketIDToHex(migp.BucketHashToID(bucketHash, bitSize))) != id {
+				return fmt.Errorf("bucket %s: entry in the wrong bucket after rebucketing", id)
+			}
+		}
+		// buckets merged for fewer bits must still fit the fixed padding
+		if err := cfg.Padding.CheckEntries(len(bucketEntries)); err != nil {
+			return fmt.Errorf("bucket %s: %w", id, err)
+		}
+		entries += int64(len(bucketEntries))
+		stats.Buckets++
+		return nil
+	})
+	if err != nil {
+		return cfg, stats, err
+	}
+	if entries != stats.Entries {
+		return cfg, stats, fmt.Errorf("want %d entries after rebucketing, found %d", stats.Entries, entries)
+	}
+
+	cfg.BucketIDBitSize = bitSize
+	return cfg, stats, nil
+}
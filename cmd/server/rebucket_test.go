@@ -0,0 +1,278 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// TestRebucket rebuckets a dataset to a smaller bit size, and switches a
+// running server over to it
+func TestRebucket(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	src := store.NewMemoryStore()
+	s, err := newServer(cfg, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usernames := []string{"username1", "username2", "username3", "username4"}
+	opts := ingestOptions{phaseNum: 1, includeUsernameVariant: true, recordBucketHash: true}
+	for _, username := range usernames {
+		if err := s.insert([]byte(username), []byte("password1"), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := store.NewMemoryStore()
+	newCfg, stats, err := rebucket(src, dst, cfg, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newCfg.BucketIDBitSize != 1 || stats.Entries != int64(2*len(usernames)) || stats.Buckets > 2 {
+		t.Fatalf("want %d entries in at most 2 buckets of 1-bit IDs, got %d bits and %+v", 2*len(usernames), newCfg.BucketIDBitSize, stats)
+	}
+
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+	if _, err := s.reload(newCfg, dst); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(httpServer.URL + "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var clientCfg migp.Config
+	if err := json.NewDecoder(resp.Body).Decode(&clientCfg); err != nil {
+		t.Fatal(err)
+	}
+	if clientCfg.BucketIDBitSize != 1 {
+		t.Fatalf("want 1-bit bucket IDs after reload, got %d", clientCfg.BucketIDBitSize)
+	}
+
+	for _, username := range usernames {
+		status, _, err := migp.Query(clientCfg, httpServer.URL+"/evaluate", []byte(username), []byte("password1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != migp.InBreach {
+			t.Errorf("%s: want %s, got %s", username, migp.InBreach, status)
+		}
+	}
+}
+
+func TestRebucketErrors(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	src := store.NewMemoryStore()
+	s, err := newServer(cfg, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.insert([]byte("username1"), []byte("password1"), ingestOptions{phaseNum: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rebucket(src, store.NewMemoryStore(), cfg, 8, 0); err == nil {
+		t.Error("expected error rebucketing entries without recorded bucket hashes")
+	}
+
+	bound := cfg
+	bound.PublicInput = migp.PublicInputBucketID
+	if _, _, err := rebucket(src, store.NewMemoryStore(), bound, 8, 0); !errors.Is(err, errBucketIDBound) {
+		t.Errorf("want %v, got %v", errBucketIDBound, err)
+	}
+	if _, _, err := rebucket(src, store.NewMemoryStore(), cfg, 33, 0); err == nil {
+		t.Error("expected error for out of range bit size")
+	}
+
+	// merged buckets must fit the fixed padding size
+	padded := cfg
+	padded.Padding = migp.PaddingConfig{Policy: migp.PaddingFixed, Entries: 1}
+	src = store.NewMemoryStore()
+	if s, err = newServer(padded, src); err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"username1", "username2"} {
+		if err := s.insert([]byte(username), []byte("password1"), ingestOptions{phaseNum: 1, recordBucketHash: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := rebucket(src, store.NewMemoryStore(), padded, 0, 0); !errors.Is(err, migp.ErrBucketTooLarge) {
+		t.Errorf("want %v, got %v", migp.ErrBucketTooLarge, err)
+	}
+}
+
+// TestReloadInFlight reloads a server while a request is in flight. New
+// requests are served with the new store at once, and the old store is only
+// returned for closing once the request in flight has finished.
+func TestReloadInFlight(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	s, err := newServer(cfg, store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	inFlight, done := s.acquire()
+	replaced := make(chan store.Store, 1)
+	dst := store.NewMemoryStore()
+	go func() {
+		old, err := s.reload(cfg, dst)
+		if err != nil {
+			t.Error(err)
+		}
+		replaced <- old
+	}()
+
+	deadline := time.After(10 * time.Second)
+	for {
+		current, currentDone := s.acquire()
+		currentDone()
+		if current.kv == dst {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("reload did not replace the store")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	resp, err := http.Get(httpServer.URL + "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want status %d during reload, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	select {
+	case <-replaced:
+		t.Fatal("reload returned the old store while a request was using it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	done()
+	select {
+	case old := <-replaced:
+		if old != inFlight.kv {
+			t.Error("reload did not return the old store")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("reload did not return after the request finished")
+	}
+}
+
+// TestReloadOnHangup switches a server backed by the file store over to a
+// rebucketed database file on SIGHUP, keeping the open store as long as the
+// file hasn't been replaced
+func TestReloadOnHangup(t *testing.T) {
+	dir := t.TempDir()
+	configFile, storePath := filepath.Join(dir, "config"), filepath.Join(dir, "buckets.db")
+	writeConfig := func(cfg migp.ServerConfig) {
+		data, err := json.Marshal(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(configFile, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := migp.DefaultServerConfig()
+	writeConfig(cfg)
+	kv, err := store.Open(store.BackendFile, storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(cfg, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	opts := ingestOptions{phaseNum: 1, recordBucketHash: true}
+	if err := s.insert([]byte("username1"), []byte("password1"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer func() {
+		signal.Stop(hangup)
+		close(hangup)
+	}()
+	results := make(chan error, 1)
+	go reloadOnHangup(s, configFile, store.BackendFile, storePath, hangup, func(err error) { results <- err })
+	signalHangup := func() {
+		t.Helper()
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Fatalf("reload: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("no reload after SIGHUP")
+		}
+	}
+
+	// the open file is kept rather than reopened
+	signalHangup()
+	if s.kv != kv {
+		t.Fatal("reload replaced the store without a new database file")
+	}
+
+	rebucketedPath := filepath.Join(dir, "rebucketed.db")
+	dst, err := store.Open(store.BackendFile, rebucketedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCfg, _, err := rebucket(kv, dst, cfg, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(newCfg)
+	if err := os.Rename(rebucketedPath, storePath); err != nil {
+		t.Fatal(err)
+	}
+	signalHangup()
+	if s.kv == kv {
+		t.Fatal("reload kept the store after the database file was replaced")
+	}
+
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+	clientCfg := s.migpServer.Config().Config
+	if clientCfg.BucketIDBitSize != 1 {
+		t.Fatalf("want 1-bit bucket IDs after reload, got %d", clientCfg.BucketIDBitSize)
+	}
+	status, _, err := migp.Query(clientCfg, httpServer.URL+"/evaluate", []byte("username1"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != migp.InBreach {
+		t.Errorf("want %s, got %s", migp.InBreach, status)
+	}
+
+	var current os.FileInfo
+	if err := s.reloadFrom(configFile, store.BackendMemory, "", &current); !errors.Is(err, errReloadMemory) {
+		t.Errorf("memory backend: want %v, got %v", errReloadMemory, err)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// maxRemoveAttempts bounds how often removal from a bucket is retried when
+// the bucket changes between reading and rewriting it
+const maxRemoveAttempts = 10
+
+// removeOptions controls which entries are removed for a credential pair
+type removeOptions struct {
+	// usernameEntry also removes the username-only entry, which is shared
+	// by every password breached for the username
+	usernameEntry bool
+
+	// variants also removes the similar password entries, which are
+	// regenerated as phase two generated them
+	variants    bool
+	numVariants int
+}
+
+// removeStats summarizes a removal run. Unmatched counts the regenerated
+// password variants without an entry in the username's bucket for any key
+// epoch. Phase two stores a random variant instead of one whose entry
+// already exists, and such entries can't be matched, so they remain.
+type removeStats struct {
+	Credentials int64
+	Found       int64
+	Entries     int64
+	Unmatched   int64
+	Malformed   int64
+}
+
+// errRemovePagPassGPT is returned when removing variants generated with
+// PagPassGPT, which doesn't generate the same variants twice
+var errRemovePagPassGPT = errors.New("variants generated using PagPassGPT can't be regenerated, so their entries can't be removed")
+
+// runRemove implements the remove command, which takes down the entries for
+// credentials read in the format <username>:<password> from the store
+func runRemove(args []string) error {
+	var configFile, storeBackend, storePath, inputFilename string
+	var usePagPassGPT bool
+	var opts removeOptions
+
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "Server configuration file")
+	fs.StringVar(&storeBackend, "store", store.BackendPostgres, "storage backend to remove entries from: memory, file, or postgres")
+	fs.StringVar(&storePath, "store-path", "", "database file for the file backend, or connection string for the postgres backend (default: $DB_CONNECTION_ST)")
+	fs.StringVar(&inputFilename, "infile", "-", "input file of credentials to remove in the format <username>:<password>[<tab><json metadata>] ('-' for stdin)")
+	fs.BoolVar(&opts.usernameEntry, "username-entry", false, "also remove the username-only entry")
+	fs.BoolVar(&opts.variants, "variants", false, "also remove the password variant entries")
+	fs.IntVar(&opts.numVariants, "num-variants", 9, "number of password variants the entries were ingested with")
+	fs.BoolVar(&usePagPassGPT, "use-pagpassgpt", false, "the password variants were generated using PagPassGPT, which is not supported")
+	fs.Parse(args)
+
+	if usePagPassGPT {
+		return errRemovePagPassGPT
+	}
+	if configFile == "" {
+		return errors.New("remove requires the server configuration given with -config")
+	}
+	cfg, err := loadServerConfig(configFile)
+	if err != nil {
+		return err
+	}
+	kv, err := openStore(storeBackend, storePath)
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	s, err := newServer(cfg, kv)
+	if err != nil {
+		return err
+	}
+
+	input := os.Stdin
+	if inputFilename != "-" {
+		if input, err = os.Open(inputFilename); err != nil {
+			return err
+		}
+		defer input.Close()
+	}
+
+	stats, err := s.removeCredentials(input, opts)
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed %d entries for %d of %d credentials (%d malformed lines)", stats.Entries, stats.Found, stats.Credentials, stats.Malformed)
+	if stats.Unmatched > 0 {
+		log.Printf("Warning: %d password variants had no entry; any random variants stored in their place at ingest remain", stats.Unmatched)
+	}
+	return nil
+}
+
+// removeCredentials removes the entries for each credential pair read from
+// r. Per-line metadata is ignored, since entries are matched whatever their
+// metadata.
+func (s *server) removeCredentials(r io.Reader, opts removeOptions) (removeStats, error) {
+	var stats removeStats
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _ := splitLineMetadata(scanner.Bytes())
+		fields := bytes.SplitN(line, []byte(":"), 2)
+		if len(fields) < 2 {
+			stats.Malformed++
+			continue
+		}
+		username, password := fields[0], fields[1]
+		passwords := [][]byte{password}
+		if opts.usernameEntry {
+			passwords = append(passwords, nil)
+		}
+		removed, err := s.remove(username, passwords)
+		if err != nil {
+			return stats, err
+		}
+		if opts.variants {
+			variants, err := generateVariants(password, ingestOptions{numVariants: opts.numVariants})
+			if err != nil {
+				return stats, err
+			}
+			// a variant is matched if its entry is found for any epoch
+			var matched int
+			for _, epoch := range s.migpServer.Epochs() {
+				n, err := s.removeFromEpoch(epoch, username, variants)
+				if err != nil {
+					return stats, err
+				}
+				removed += n
+				if n > matched {
+					matched = n
+				}
+			}
+			if matched < len(variants) {
+				stats.Unmatched += int64(len(variants) - matched)
+			}
+		}
+		stats.Credentials++
+		if removed > 0 {
+			stats.Found++
+			stats.Entries += int64(removed)
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// remove removes the entries encrypted for username and any of passwords
+// from the username's buckets for every key epoch the server holds, so that
+// clients still querying the previous epoch during a key rotation no longer
+// find them either. It returns the number of entries removed.
+func (s *server) remove(username []byte, passwords [][]byte) (int, error) {
+	var total int
+	for _, epoch := range s.migpServer.Epochs() {
+		removed, err := s.removeFromEpoch(epoch, username, passwords)
+		if err != nil {
+			return total, err
+		}
+		total += removed
+	}
+	return total, nil
+}
+
+// removeFromEpoch removes the entries encrypted for username and any of
+// passwords from the username's bucket for epoch, along with their shadow
+// index and bucket hash records. It returns the number of entries removed.
+func (s *server) removeFromEpoch(epoch uint32, username []byte, passwords [][]byte) (int, error) {
+	bucketKey := migp.BucketKey(epoch, migp.BucketIDToHex(s.migpServer.BucketID(username)))
+	for attempt := 0; attempt < maxRemoveAttempts; attempt++ {
+		contents, err := s.kv.Get(bucketKey)
+		if err != nil {
+			return 0, err
+		}
+		remaining, removed, err := s.migpServer.RemoveBucketEntries(epoch, contents, username, passwords)
+		if err != nil {
+			return 0, fmt.Errorf("bucket %s: %w", bucketKey, err)
+		}
+		if len(removed) == 0 {
+			return 0, nil
+		}
+		metaKeys := make([]string, len(removed))
+		for i, entry := range removed {
+			metaKeys[i] = bucketHashKey(entry)
+		}
+		err = s.kv.Remove(bucketKey, contents, remaining, removed, metaKeys)
+		if err == store.ErrConflict {
+			// entries were appended concurrently, so match again
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		return len(removed), nil
+	}
+	return 0, fmt.Errorf("bucket %s: %w", bucketKey, store.ErrConflict)
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// TestRemove takes down a credential pair and its variants, and checks that
+// the other entries in the bucket are still found
+func TestRemove(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	kv := store.NewMemoryStore()
+	s, err := newServer(cfg, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phaseOne := ingestOptions{phaseNum: 1, includeUsernameVariant: true, recordBucketHash: true}
+	phaseTwo := ingestOptions{phaseNum: 2, numVariants: 3, recordBucketHash: true}
+	for _, password := range []string{"password1", "password2"} {
+		for _, opts := range []ingestOptions{phaseOne, phaseTwo} {
+			if err := s.insert([]byte("username1"), []byte(password), opts); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	variant := generateVariantsOrFatal(t, []byte("password1"), 3)[0]
+
+	opts := removeOptions{variants: true, numVariants: 3}
+	input := "username1:password1\t{}\nmalformed\nusername2:password1\n"
+	stats, err := s.removeCredentials(strings.NewReader(input), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// username2 was never ingested, so none of its variants match
+	want := removeStats{Credentials: 2, Found: 1, Entries: 4, Unmatched: 3, Malformed: 1}
+	if stats != want {
+		t.Fatalf("want %+v, got %+v", want, stats)
+	}
+
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+	clientCfg := cfg.Config
+	for _, test := range []struct {
+		password string
+		want     migp.BreachStatus
+	}{
+		{"password1", migp.NotInBreach},
+		{string(variant), migp.NotInBreach},
+		{"password2", migp.InBreach},
+	} {
+		status, _, err := migp.Query(clientCfg, httpServer.URL+"/evaluate", []byte("username1"), []byte(test.password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.want {
+			t.Errorf("%s: want %s, got %s", test.password, test.want, status)
+		}
+	}
+
+	// the username-only entry goes too when requested, and the bucket hash
+	// records of removed entries are deleted
+	removed, err := s.remove([]byte("username1"), [][]byte{[]byte("password2"), nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("want 2 entries removed, got %d", removed)
+	}
+	contents, err := kv.Get(s.migpServer.BucketKey([]byte("username1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := migp.SplitBucketEntries(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("want the 3 variant entries of password2 left, got %d entries", len(entries))
+	}
+	var records int
+	err = kv.ForEachMeta(func(key string, value []byte) error {
+		if strings.HasPrefix(key, "bucket-hash/") {
+			records++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records != len(entries) {
+		t.Fatalf("want %d bucket hash records, got %d", len(entries), records)
+	}
+
+	// a removed credential pair can be ingested again
+	if err := s.insert([]byte("username1"), []byte("password1"), phaseOne); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRemoveDuringRotation removes a credential pair while the server holds
+// the previous epoch's key, from the buckets of both epochs
+func TestRemoveDuringRotation(t *testing.T) {
+	username, password := []byte("username1"), []byte("password1")
+	kv := store.NewMemoryStore()
+	oldCfg := migp.DefaultServerConfig()
+	oldServer, err := newServer(oldCfg, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ingestOptions{phaseNum: 1, includeUsernameVariant: true}
+	if err := oldServer.insert(username, password, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := oldServer.insert(username, []byte("password2"), ingestOptions{phaseNum: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	newCfg := migp.DefaultServerConfig()
+	newCfg.Epoch = oldCfg.Epoch + 1
+	newCfg.PreviousPrivateKey = oldCfg.PrivateKey
+	s, err := newServer(newCfg, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the credential pair has been re-encrypted so far
+	if err := s.insert(username, password, ingestOptions{phaseNum: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := s.removeCredentials(strings.NewReader("username1:password1\n"), removeOptions{usernameEntry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := removeStats{Credentials: 1, Found: 1, Entries: 3}
+	if stats != want {
+		t.Fatalf("want %+v, got %+v", want, stats)
+	}
+
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+	for _, test := range []struct {
+		cfg      migp.Config
+		password string
+		want     migp.BreachStatus
+	}{
+		{oldCfg.Config, "password1", migp.NotInBreach},
+		{oldCfg.Config, "password2", migp.InBreach},
+		{newCfg.Config, "password1", migp.NotInBreach},
+	} {
+		status, _, err := migp.Query(test.cfg, httpServer.URL+"/evaluate", username, []byte(test.password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.want {
+			t.Errorf("epoch %d, %s: want %s, got %s", test.cfg.Epoch, test.password, test.want, status)
+		}
+	}
+}
+
+// TestRemovePagPassGPT refuses to remove PagPassGPT variants, which can't be
+// regenerated
+func TestRemovePagPassGPT(t *testing.T) {
+	if err := runRemove([]string{"-variants", "-use-pagpassgpt"}); !errors.Is(err, errRemovePagPassGPT) {
+		t.Errorf("want %v, got %v", errRemovePagPassGPT, err)
+	}
+}
+
+func generateVariantsOrFatal(t *testing.T, password []byte, numVariants int) [][]byte {
+	t.Helper()
+	variants, err := generateVariants(password, ingestOptions{numVariants: numVariants})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) == 0 {
+		t.Fatal("no variants generated")
+	}
+	return variants
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// epochActiveKey returns the store metadata key recording that the buckets
+// for the given key epoch are complete and the epoch can be advertised
+func epochActiveKey(epoch uint32) string {
+	return fmt.Sprintf("epoch/%d/active", epoch)
+}
+
+// activeEpoch returns the key epoch advertised to clients. While the server
+// holds the previous epoch's key, buckets are still being migrated to the
+// current epoch, which is only advertised once it has been activated.
+func (s *server) activeEpoch() (uint32, error) {
+	cfg := s.migpServer.Config()
+	if cfg.PreviousPrivateKey == nil {
+		return cfg.Epoch, nil
+	}
+	active, err := s.kv.GetMeta(epochActiveKey(cfg.Epoch))
+	if err != nil {
+		return 0, err
+	}
+	if active == nil {
+		return cfg.Epoch - 1, nil
+	}
+	return cfg.Epoch, nil
+}
+
+// activeConfig returns the client configuration for the active key epoch
+func (s *server) activeConfig() (migp.Config, error) {
+	epoch, err := s.activeEpoch()
+	if err != nil {
+		return migp.Config{}, err
+	}
+	return s.migpServer.EpochConfig(epoch)
+}
+
+// activateEpoch marks the buckets for the current key epoch as complete, so
+// that the epoch is advertised to clients
+func (s *server) activateEpoch() error {
+	return s.kv.PutMeta(epochActiveKey(s.migpServer.Epoch()), []byte{1})
+}
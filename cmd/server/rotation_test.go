@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// fetchConfig returns the client configuration served at url
+func fetchConfig(t *testing.T, url string) migp.Config {
+	t.Helper()
+	resp, err := http.Get(url + "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var cfg migp.Config
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// TestKeyRotation migrates buckets to a new key epoch and checks that both
+// epochs answer queries, and that /config only advertises the new epoch once
+// it has been activated
+func TestKeyRotation(t *testing.T) {
+	username, password := []byte("username1"), []byte("password1")
+	input := string(username) + ":" + string(password) + "\n"
+	opts := ingestOptions{phaseNum: 1, metadata: []byte("rotation"), includeUsernameVariant: true}
+	kv := store.NewMemoryStore()
+
+	oldCfg := migp.DefaultServerConfig()
+	oldServer, err := newServer(oldCfg, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oldServer.ingest(strings.NewReader(input), opts, pipelineConfig{}, ingestProgress{}); err != nil {
+		t.Fatal(err)
+	}
+
+	newCfg := migp.DefaultServerConfig()
+	newCfg.Epoch = oldCfg.Epoch + 1
+	newCfg.PreviousPrivateKey = oldCfg.PrivateKey
+	s, err := newServer(newCfg, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	query := func(cfg migp.Config) migp.BreachStatus {
+		status, _, err := migp.Query(cfg, httpServer.URL+"/evaluate", username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	// the previous epoch is advertised until migration completes
+	cfg := fetchConfig(t, httpServer.URL)
+	if cfg.Epoch != oldCfg.Epoch {
+		t.Fatalf("epoch before migration: want %d, got %d", oldCfg.Epoch, cfg.Epoch)
+	}
+	if status := query(cfg); status != migp.InBreach {
+		t.Fatalf("status before migration: want %s, got %s", migp.InBreach, status)
+	}
+
+	if _, err := s.ingest(strings.NewReader(input), opts, pipelineConfig{}, ingestProgress{}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fetchConfig(t, httpServer.URL); cfg.Epoch != oldCfg.Epoch {
+		t.Fatalf("epoch before activation: want %d, got %d", oldCfg.Epoch, cfg.Epoch)
+	}
+	if err := s.activateEpoch(); err != nil {
+		t.Fatal(err)
+	}
+
+	// both epochs answer queries after activation
+	newClientCfg := fetchConfig(t, httpServer.URL)
+	if newClientCfg.Epoch != newCfg.Epoch {
+		t.Fatalf("epoch after activation: want %d, got %d", newCfg.Epoch, newClientCfg.Epoch)
+	}
+	for _, cfg := range []migp.Config{cfg, newClientCfg} {
+		if status := query(cfg); status != migp.InBreach {
+			t.Fatalf("status in epoch %d: want %s, got %s", cfg.Epoch, migp.InBreach, status)
+		}
+	}
+}
@@ -6,74 +6,118 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
-	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"mime"
 	"net/http"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 
 	"github.com/erikathea/migp-go/pkg/migp"
 	"github.com/erikathea/migp-go/pkg/mutator"
-
-	_ "github.com/lib/pq"
+	"github.com/erikathea/migp-go/pkg/store"
 )
 
 // newServer returns a new server initialized using the provided configuration
-func newServer(cfg migp.ServerConfig) (*server, error) {
+// and backing store
+func newServer(cfg migp.ServerConfig, kv store.Store) (*server, error) {
 	migpServer, err := migp.NewServer(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	dbConnectionString := os.Getenv("DB_CONNECTION_ST")
-	if dbConnectionString == "" {
-		log.Println("DB_CONNECTION_ST environment variable not set. Using default localhost connection string.")
-		dbConnectionString = "user=cs-db password=hacker dbname=cs-db sslmode=disable host=localhost"
-	}
-
-	log.Printf("Using database connection string: %s", dbConnectionString)
-	db, err := sql.Open("postgres", dbConnectionString)
-	if err != nil {
-		log.Fatalf("Error opening database: %v", err)
-	}
-
-	if err = db.Ping(); err != nil {
-		log.Fatalf("Error connecting to the database: %v", err)
-	}
-
-	kv, err := newKVStore(db)
-	if err != nil {
-		return nil, err
-	}
-
 	return &server{
 		migpServer: migpServer,
-		kv:		 kv,
+		kv:         kv,
+		requests:   new(sync.WaitGroup),
 	}, nil
 }
 
 // server wraps a MIGP server and backing KV store
 type server struct {
 	migpServer *migp.Server
-	kv		 *kvStore
+	kv         store.Store
+
+	// requests counts the requests in flight that use kv
+	requests *sync.WaitGroup
+
+	// mu guards migpServer, kv and requests, which reload replaces
+	mu sync.RWMutex
 }
 
 // handler handles client requests
 func (s *server) handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleIndex)
-	mux.HandleFunc("/evaluate", s.handleEvaluate)
-	mux.HandleFunc("/config", s.handleConfig)
+	mux.HandleFunc("/evaluate", s.serve((*server).handleEvaluate))
+	mux.HandleFunc("/evaluate-batch", s.serve((*server).handleEvaluateBatch))
+	mux.HandleFunc("/oprf", s.serve((*server).handleOPRF))
+	mux.HandleFunc("/config", s.serve((*server).handleConfig))
 	return mux
 }
 
+// serve returns a handler that calls handle with the server's current
+// configuration and store, so that a request never sees the configuration
+// of one reload with the buckets of another
+func (s *server) serve(handle func(*server, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		current, done := s.acquire()
+		defer done()
+		handle(current, w, req)
+	}
+}
+
+// acquire returns a copy of the server with its current configuration and
+// store. The store stays open until done is called.
+func (s *server) acquire() (current *server, done func()) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.requests.Add(1)
+	current = &server{migpServer: s.migpServer, kv: s.kv, requests: s.requests}
+	return current, s.requests.Done
+}
+
+// reload replaces the server's configuration and store at once. Requests
+// that start afterwards use the new ones, while requests in flight finish
+// with the old ones. It returns the replaced store once those requests have
+// finished, so that it can be closed. A nil kv keeps the current store, and
+// nil is returned.
+func (s *server) reload(cfg migp.ServerConfig, kv store.Store) (store.Store, error) {
+	migpServer, err := migp.NewServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.migpServer = migpServer
+	if kv == nil {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	old, requests := s.kv, s.requests
+	s.kv, s.requests = kv, new(sync.WaitGroup)
+	s.mu.Unlock()
+
+	requests.Wait()
+	return old, nil
+}
+
+// close closes the store the server currently uses, once the requests in
+// flight have finished
+func (s *server) close() error {
+	s.mu.Lock()
+	kv, requests := s.kv, s.requests
+	s.mu.Unlock()
+	requests.Wait()
+	return kv.Close()
+}
+
 // GenerateRandomString generates a random λ-bits long string
 func GenerateRandomString(bits int) ([]byte, error) {
 	bytes := int(math.Ceil(float64(bits) / 8.0))
@@ -87,107 +131,142 @@ func GenerateRandomString(bits int) ([]byte, error) {
 	return randomBytes, nil
 }
 
+// ingestOptions controls how a credential pair is expanded into bucket entries
+type ingestOptions struct {
+	phaseNum               int
+	metadata               []byte
+	numVariants            int
+	includeUsernameVariant bool
+	usePagPassGPT          bool
+
+	// recordBucketHash records the full bucket hash of each entry in the
+	// store's metadata, so that the entries can later be rebucketed
+	recordBucketHash bool
+}
+
 // insert encrypts a credential pair and stores it in the configured KV store
-func (s *server) insert(username, password, metadata []byte, numVariants int, includeUsernameVariant bool, phaseNum int, usePagPassGPT bool) error {
-	var (
-		newEntry []byte
-		err error
-		passwordVariants [][]byte
-	)
-	bucketIDHex := migp.BucketIDToHex(s.migpServer.BucketID(username))
-	log.Println("----ID ", bucketIDHex)
-	if phaseNum==1 {
-		newEntry, err := s.migpServer.EncryptBucketEntry(username, password, migp.MetadataBreachedPassword, metadata)
+func (s *server) insert(username, password []byte, opts ingestOptions) error {
+	entries, err := s.encryptEntries(username, password, opts)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		// AppendBatch also stores the entry's bucket hash record, if any
+		appended, err := s.kv.AppendBatch([]store.Entry{entry})
 		if err != nil {
 			return err
 		}
-
-		if !s.kv.checkIfUnique(newEntry) {
+		if appended == 0 && opts.phaseNum == 1 && i == 0 {
 			return errors.New("skipping duplicate entry")
 		}
+	}
+	return nil
+}
 
-		err = s.kv.Append(bucketIDHex, newEntry)
+// encryptEntries encrypts the bucket entries for a credential pair without
+// storing them. In phase one these are the breached password entry followed
+// by the optional username-only entry; in phase two they are the similar
+// password entries for each generated password variant.
+func (s *server) encryptEntries(username, password []byte, opts ingestOptions) ([]store.Entry, error) {
+	var (
+		newEntry         []byte
+		err              error
+		entries          []store.Entry
+		passwordVariants [][]byte
+	)
+	bucketKey := s.migpServer.BucketKey(username)
+	if opts.phaseNum == 1 {
+		newEntry, err = s.migpServer.EncryptBucketEntry(username, password, migp.MetadataBreachedPassword, opts.metadata)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		s.kv.insertShadow(bucketIDHex, newEntry)
-		log.Println("newEntry ", base64.StdEncoding.EncodeToString(newEntry))
+		entries = append(entries, store.Entry{ID: bucketKey, Value: newEntry})
 
-		if includeUsernameVariant {
-			newEntry, err = s.migpServer.EncryptBucketEntry(username, nil, migp.MetadataBreachedUsername, metadata)
+		if opts.includeUsernameVariant {
+			newEntry, err = s.migpServer.EncryptBucketEntry(username, nil, migp.MetadataBreachedUsername, opts.metadata)
 			if err != nil {
-				return err
-			}
-
-			if !s.kv.checkIfUnique(newEntry){
-				log.Println("-- skipping duplicate username-variant entry")
-			} else {
-				err = s.kv.Append(bucketIDHex, newEntry)
-				if err != nil {
-					return err
-				}
-				s.kv.insertShadow(bucketIDHex, newEntry)
-				log.Println("-- includeUsernameVariant ", base64.StdEncoding.EncodeToString(newEntry))
+				return nil, err
 			}
+			entries = append(entries, store.Entry{ID: bucketKey, Value: newEntry})
 		}
-	} else if phaseNum==2 {
-		if usePagPassGPT {
-			cwd, err_ := os.Getwd()
-			if err_ != nil {
-			    fmt.Println("Error getting current working directory:", err_)
-			    return err_
-			}
-			cmd := exec.Command(cwd+"/run_pagpassgpt.sh", string(password), fmt.Sprintf("%d", numVariants))
-
-			var out bytes.Buffer
-			var stderr bytes.Buffer
-			cmd.Stdout = &out
-			cmd.Stderr = &stderr
-
-			err := cmd.Run()
-			if err != nil {
-				fmt.Println("Error executing script:", err)
-				fmt.Println("Script stderr:", stderr.String())
-				return err
-			}
-			outputStr := out.String()
-			passwords := strings.Split(outputStr, "\n")
-			passwordSet := make(map[string]struct{}) // Create a set to store unique passwords
-			for _, password := range passwords {
-				if password != "" {
-					passwordSet[password] = struct{}{}
-				}
-			}
-			for password := range passwordSet {
-				passwordVariants = append(passwordVariants, []byte(password))
-				log.Println("   gpt-variant ", string(password))
-			}
-		} else {
-			passwordVariants = mutator.NewRDasMutator().Mutate(password, numVariants)
+	} else if opts.phaseNum == 2 {
+		passwordVariants, err = generateVariants(password, opts)
+		if err != nil {
+			return nil, err
 		}
 		for _, variant := range passwordVariants {
-			newEntry, err = s.migpServer.EncryptBucketEntry(username, variant, migp.MetadataSimilarPassword, metadata)
+			newEntry, err = s.migpServer.EncryptBucketEntry(username, variant, migp.MetadataSimilarPassword, opts.metadata)
 			// Ensure the value is unique before appending
 			attempt := 0
-			for !s.kv.checkIfUnique(newEntry) && attempt < 10 {
+			for err == nil && attempt < 10 {
+				var unique bool
+				if unique, err = s.kv.IsUnique(newEntry); err != nil || unique {
+					break
+				}
 				randomString, _ := GenerateRandomString(256)
 				altVariant := mutator.NewRDasMutator().Mutate(randomString, 1)
-				newEntry, err = s.migpServer.EncryptBucketEntry(username, altVariant[0], migp.MetadataSimilarPassword, metadata)
+				newEntry, err = s.migpServer.EncryptBucketEntry(username, altVariant[0], migp.MetadataSimilarPassword, opts.metadata)
 				attempt++
 			}
 			if err != nil {
-				return err
+				return nil, err
 			}
-			err = s.kv.Append(bucketIDHex, newEntry)
-			if err != nil {
-				return err
-			}
-			s.kv.insertShadow(bucketIDHex, newEntry)
+			entries = append(entries, store.Entry{ID: bucketKey, Value: newEntry})
+		}
+	}
+	if opts.recordBucketHash {
+		// the store writes the record only if it appends the entry
+		bucketHash := s.migpServer.BucketHash(username)
+		for i := range entries {
+			entries[i].Meta = map[string][]byte{bucketHashKey(entries[i].Value): bucketHash}
 		}
 	}
+	return entries, nil
+}
 
-	log.Println("ID ", bucketIDHex)
-	return nil
+// generateVariants generates the similar password variants of password
+// that phase two encrypts
+func generateVariants(password []byte, opts ingestOptions) ([][]byte, error) {
+	if opts.usePagPassGPT {
+		return pagPassGPTVariants(password, opts.numVariants)
+	}
+	return mutator.NewRDasMutator().Mutate(password, opts.numVariants), nil
+}
+
+// pagPassGPTVariants generates up to numVariants unique password variants
+// using the PagPassGPT model
+func pagPassGPTVariants(password []byte, numVariants int) ([][]byte, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Println("Error getting current working directory:", err)
+		return nil, err
+	}
+	cmd := exec.Command(cwd+"/run_pagpassgpt.sh", string(password), fmt.Sprintf("%d", numVariants))
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		fmt.Println("Error executing script:", err)
+		fmt.Println("Script stderr:", stderr.String())
+		return nil, err
+	}
+	outputStr := out.String()
+	passwords := strings.Split(outputStr, "\n")
+	passwordSet := make(map[string]struct{}) // Create a set to store unique passwords
+	for _, password := range passwords {
+		if password != "" {
+			passwordSet[password] = struct{}{}
+		}
+	}
+	var passwordVariants [][]byte
+	for password := range passwordSet {
+		passwordVariants = append(passwordVariants, []byte(password))
+		log.Println("   gpt-variant ", string(password))
+	}
+	return passwordVariants, nil
 }
 
 // handleIndex returns a welcome message
@@ -195,48 +274,201 @@ func (s *server) handleIndex(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "Welcome to the MIGP demo server\n")
 }
 
-// handleConfig returns the MIGP configuration
+// handleConfig returns the MIGP configuration for the active key epoch
 func (s *server) handleConfig(w http.ResponseWriter, req *http.Request) {
+	epoch, err := s.activeEpoch()
+	if err != nil {
+		log.Println("Reading active epoch failed:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	cfg, err := s.migpServer.EpochConfig(epoch)
+	if err != nil {
+		log.Println("Reading epoch config failed:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 	encoder := json.NewEncoder(w)
-	cfg := s.migpServer.Config().Config
 	if err := encoder.Encode(cfg); err != nil {
 		log.Println("Writing response failed:", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
 
-// handleEvaluate serves a request from a MIGP client
-func (s *server) handleEvaluate(w http.ResponseWriter, req *http.Request) {
-	body, err := ioutil.ReadAll(req.Body)
+var errUnsupportedContentType = errors.New("unsupported content type")
+
+// requestErrorStatus maps an error from handling a MIGP request to an HTTP
+// status code. Errors caused by the request are client errors, anything else
+// is a server error.
+func requestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, migp.ErrVersionMismatch),
+		errors.Is(err, migp.ErrInvalidBucketID),
+		errors.Is(err, migp.ErrMalformedElement),
+		errors.Is(err, migp.ErrUnknownEpoch):
+		return http.StatusBadRequest
+	case errors.Is(err, migp.ErrBatchTooLarge):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// decodeClientRequest decodes a client request body according to its content
+// type, which defaults to JSON
+func decodeClientRequest(contentType string, body []byte) (migp.ClientRequest, error) {
+	var request migp.ClientRequest
+	mediaType := migp.ContentTypeJSON
+	if contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return request, errUnsupportedContentType
+		}
+	}
+	switch mediaType {
+	case migp.ContentTypeJSON:
+		return request, json.Unmarshal(body, &request)
+	case migp.ContentTypeBinary:
+		return request, request.UnmarshalBinary(body)
+	default:
+		return request, errUnsupportedContentType
+	}
+}
+
+// Limits on request body sizes. A batch holds up to migp.MaxBatchSize
+// requests.
+const (
+	maxEvaluateBodySize = 16 << 10
+	maxBatchBodySize    = 2 << 20
+)
+
+// errorResponse is the JSON body of error responses
+type errorResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// writeError writes a JSON error response with the given status. The error
+// detail is only included for client errors, so that server internals are
+// not exposed.
+func writeError(w http.ResponseWriter, status int, err error) {
+	body := errorResponse{Status: status, Error: http.StatusText(status)}
+	if err != nil && status < http.StatusInternalServerError {
+		body.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(&body); err != nil {
+		log.Println("Writing error response failed:", err)
+	}
+}
+
+// readRequestBody reads the body of a POST request of at most limit bytes.
+// If the request is not acceptable, it writes an error response and returns
+// false.
+func readRequestBody(w http.ResponseWriter, req *http.Request, limit int64) ([]byte, bool) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, nil)
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
 	if err != nil {
 		log.Println("Request body reading failed:", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errors.New("request body reading failed"))
+		return nil, false
+	}
+	if int64(len(body)) > limit {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body larger than %d bytes", limit))
+		return nil, false
+	}
+	return body, true
+}
+
+// handleEvaluate serves a request from a MIGP client, encoded as JSON or in
+// the binary encoding according to its Content-Type
+func (s *server) handleEvaluate(w http.ResponseWriter, req *http.Request) {
+	s.serveEvaluation(w, req, func(request migp.ClientRequest) (migp.ServerResponse, error) {
+		return s.migpServer.HandleRequest(request, s.kv)
+	})
+}
+
+// handleOPRF serves a request from a MIGP client that fetches buckets from a
+// static export, evaluating the blinded elements without reading the store
+func (s *server) handleOPRF(w http.ResponseWriter, req *http.Request) {
+	s.serveEvaluation(w, req, s.migpServer.Evaluate)
+}
+
+// serveEvaluation decodes a client request, handles it with handle and
+// writes the binary response
+func (s *server) serveEvaluation(w http.ResponseWriter, req *http.Request, handle func(migp.ClientRequest) (migp.ServerResponse, error)) {
+	body, ok := readRequestBody(w, req, maxEvaluateBodySize)
+	if !ok {
 		return
 	}
 
-	var request migp.ClientRequest
-	if err := json.Unmarshal(body, &request); err != nil {
-		log.Println("Request body unmarshal failed:", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	request, err := decodeClientRequest(req.Header.Get("Content-Type"), body)
+	if err == errUnsupportedContentType {
+		writeError(w, http.StatusUnsupportedMediaType, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("malformed request: %v", err))
+		return
 	}
 
-	migpResponse, err := s.migpServer.HandleRequest(request, s.kv)
+	migpResponse, err := handle(request)
 	if err != nil {
-		log.Println("HandleRequest failed:", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		status := requestErrorStatus(err)
+		if status >= http.StatusInternalServerError {
+			log.Println("HandleRequest failed:", err)
+		}
+		writeError(w, status, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-
 	respBody, err := migpResponse.MarshalBinary()
-	log.Println(respBody)
 	if err != nil {
 		log.Println("Response serialization failed:", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
+	w.Header().Set("Content-Type", migp.ContentTypeBinary)
 	if _, err := w.Write(respBody); err != nil {
 		log.Println("Writing response failed:", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// handleEvaluateBatch serves a batch of requests from a MIGP client
+func (s *server) handleEvaluateBatch(w http.ResponseWriter, req *http.Request) {
+	body, ok := readRequestBody(w, req, maxBatchBodySize)
+	if !ok {
+		return
+	}
+
+	var batch migp.BatchRequest
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("malformed request: %v", err))
+		return
+	}
+
+	migpResponse, err := s.migpServer.HandleBatchRequest(batch, s.kv)
+	if err != nil {
+		status := requestErrorStatus(err)
+		if status >= http.StatusInternalServerError {
+			log.Println("HandleBatchRequest failed:", err)
+		}
+		writeError(w, status, err)
+		return
+	}
+	for _, item := range migpResponse.Items {
+		if item.Internal != nil {
+			log.Println("HandleBatchRequest item failed:", item.Internal)
+		}
+	}
+
+	w.Header().Set("Content-Type", migp.ContentTypeJSON)
+	if err := json.NewEncoder(w).Encode(migpResponse); err != nil {
+		log.Println("Writing response failed:", err)
 	}
 }
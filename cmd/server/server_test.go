@@ -5,10 +5,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
 )
 
 // TestServer spins up a MIGP server and runs a series of tests
@@ -18,7 +26,7 @@ func TestServer(t *testing.T) {
 	testPassword := []byte("password1")
 	testMetadata := []byte("test metadata")
 
-	s, err := newServer(migp.DefaultServerConfig())
+	s, err := newServer(migp.DefaultServerConfig(), store.NewMemoryStore())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -40,7 +48,12 @@ func TestServer(t *testing.T) {
 	}
 
 	// insert test record
-	err = s.insert(testUsername, testPassword, testMetadata, 9, true, 1, false)
+	err = s.insert(testUsername, testPassword, ingestOptions{
+		phaseNum:               1,
+		metadata:               testMetadata,
+		numVariants:            9,
+		includeUsernameVariant: true,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,3 +70,267 @@ func TestServer(t *testing.T) {
 		t.Fatalf("metadata: want %s, got %s", testMetadata, string(metadata))
 	}
 }
+
+// TestServerBatch queries several credentials through the batch endpoint
+func TestServerBatch(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	testMetadata := []byte("test metadata")
+	if err := s.insert([]byte("username1"), []byte("password1"), ingestOptions{phaseNum: 1, metadata: testMetadata, includeUsernameVariant: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := client.QueryBatch(httpServer.URL+"/evaluate-batch", []migp.Credential{
+		{Username: []byte("username1"), Password: []byte("password1")},
+		{Username: []byte("username1"), Password: nil},
+		{Username: []byte("username2"), Password: []byte("password1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []migp.BreachStatus{migp.InBreach, migp.UsernameInBreach, migp.NotInBreach} {
+		if results[i].Err != nil {
+			t.Fatalf("result %d: %v", i, results[i].Err)
+		}
+		if results[i].Status != want {
+			t.Errorf("result %d: want %s, got %s", i, want, results[i].Status)
+		}
+	}
+	if !bytes.Equal(results[0].Metadata, testMetadata) {
+		t.Errorf("metadata: want %s, got %s", testMetadata, results[0].Metadata)
+	}
+}
+
+// failingStore is a store whose bucket reads fail
+type failingStore struct {
+	store.Store
+}
+
+func (failingStore) Get(id string) ([]byte, error) {
+	return nil, errors.New("pq: connection to 10.0.0.1 refused")
+}
+
+// TestServerBatchInternalError checks that store failures in a batch are
+// logged, but reach the client without their detail
+func TestServerBatchInternalError(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), failingStore{store.NewMemoryStore()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request([]byte("username1"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(migp.BatchRequest{Version: migp.DefaultMIGPVersion, Requests: []migp.ClientRequest{request}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	req := httptest.NewRequest(http.MethodPost, "/evaluate-batch", bytes.NewReader(body))
+	req.Header.Set("Content-Type", migp.ContentTypeJSON)
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "10.0.0.1") {
+		t.Errorf("store error detail sent to the client: %s", rec.Body.String())
+	}
+	var response migp.BatchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Items) != 1 || response.Items[0].Error != migp.ErrInternal.Error() {
+		t.Errorf("want an internal error item, got %+v", response.Items)
+	}
+	if !strings.Contains(logs.String(), "10.0.0.1") {
+		t.Errorf("store error not logged: %q", logs.String())
+	}
+}
+
+// TestServerBinaryRequests queries the server with binary encoded requests,
+// and checks that unknown request encodings are rejected
+func TestServerBinaryRequests(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	if err := s.insert([]byte("username1"), []byte("password1"), ingestOptions{phaseNum: 1}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := migp.NewHTTPClient(migp.DefaultConfig(), httpServer.URL, migp.WithBinaryRequests())
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _, err := client.Query(context.Background(), []byte("username1"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != migp.InBreach {
+		t.Fatalf("status: want %s, got %s", migp.InBreach, status)
+	}
+
+	resp, err := http.Post(httpServer.URL+"/evaluate", "text/plain", strings.NewReader("username1:password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("status code: want %d, got %d", http.StatusUnsupportedMediaType, resp.StatusCode)
+	}
+}
+
+// TestServerRequestErrors checks that invalid requests get client error
+// status codes
+func TestServerRequestErrors(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request([]byte("username1"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		modify func(*migp.ClientRequest)
+		status int
+	}{
+		{func(r *migp.ClientRequest) { r.Version++ }, http.StatusBadRequest},
+		{func(r *migp.ClientRequest) { r.BucketID = "ffffffff" }, http.StatusBadRequest},
+		{func(r *migp.ClientRequest) { r.BlindElement = []byte{1} }, http.StatusBadRequest},
+		{func(r *migp.ClientRequest) { r.Epoch = 3 }, http.StatusBadRequest},
+	} {
+		r := request
+		test.modify(&r)
+		body, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(httpServer.URL+"/evaluate", migp.ContentTypeJSON, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%+v: want status %d, got %d", r, test.status, resp.StatusCode)
+		}
+	}
+
+	body, err := json.Marshal(migp.BatchRequest{Version: migp.DefaultMIGPVersion, Requests: make([]migp.ClientRequest, migp.MaxBatchSize+1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(httpServer.URL+"/evaluate-batch", migp.ContentTypeJSON, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized batch: want status %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+}
+
+// TestHandleEvaluate checks the error paths of the evaluation handlers, and
+// that successful requests are not logged
+func TestHandleEvaluate(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := s.handler()
+
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request([]byte("username1"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.BucketID = "xyz"
+	badBucket, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path, contentType string
+		body                      []byte
+		status                    int
+	}{
+		{http.MethodGet, "/evaluate", "", nil, http.StatusMethodNotAllowed},
+		{http.MethodPut, "/evaluate-batch", migp.ContentTypeJSON, valid, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/evaluate", migp.ContentTypeJSON, make([]byte, maxEvaluateBodySize+1), http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/evaluate", migp.ContentTypeJSON, []byte("{"), http.StatusBadRequest},
+		{http.MethodPost, "/evaluate", migp.ContentTypeBinary, valid, http.StatusBadRequest},
+		{http.MethodPost, "/evaluate", "text/plain", valid, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/evaluate", migp.ContentTypeJSON, badBucket, http.StatusBadRequest},
+		{http.MethodPost, "/evaluate-batch", migp.ContentTypeJSON, []byte("[]"), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, bytes.NewReader(test.body))
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%s %s %q: want status %d, got %d", test.method, test.path, test.body, test.status, rec.Code)
+			continue
+		}
+		var body errorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s %s: error body %q: %v", test.method, test.path, rec.Body.Bytes(), err)
+		} else if body.Status != test.status || body.Error == "" {
+			t.Errorf("%s %s: unexpected error body %+v", test.method, test.path, body)
+		}
+		if test.status == http.StatusMethodNotAllowed && rec.Header().Get("Allow") != http.MethodPost {
+			t.Errorf("%s %s: want Allow %s, got %q", test.method, test.path, http.MethodPost, rec.Header().Get("Allow"))
+		}
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	req := httptest.NewRequest(http.MethodPost, "/evaluate", bytes.NewReader(valid))
+	req.Header.Set("Content-Type", migp.ContentTypeJSON)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != migp.ContentTypeBinary {
+		t.Fatalf("want status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("successful request was logged: %q", logs.String())
+	}
+}
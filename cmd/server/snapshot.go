@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// runSnapshot implements the snapshot command, which writes every bucket in
+// the store to a single snapshot file for querying offline
+func runSnapshot(args []string) error {
+	var configFile, storeBackend, storePath, outFile string
+
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "Server configuration file")
+	fs.StringVar(&storeBackend, "store", store.BackendPostgres, "storage backend for buckets: memory, file, or postgres")
+	fs.StringVar(&storePath, "store-path", "", "database file for the file backend, or connection string for the postgres backend (default: $DB_CONNECTION_ST)")
+	fs.StringVar(&outFile, "out", "migp.snapshot", "snapshot file to write")
+	fs.Parse(args)
+
+	if configFile == "" {
+		return errors.New("snapshot requires the server configuration given with -config")
+	}
+	cfg, err := loadServerConfig(configFile)
+	if err != nil {
+		return err
+	}
+	kv, err := openStore(storeBackend, storePath)
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	s, err := newServer(cfg, kv)
+	if err != nil {
+		return err
+	}
+
+	if err := s.writeSnapshot(outFile); err != nil {
+		return err
+	}
+	snapshot, err := migp.OpenSnapshot(outFile)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	log.Printf("Wrote snapshot of %d buckets to %s", snapshot.Len(), outFile)
+	return nil
+}
+
+// writeSnapshot writes a snapshot of the store, with the client
+// configuration for the active epoch, to path. The snapshot is written to a
+// temporary file that replaces path once complete.
+func (s *server) writeSnapshot(path string) error {
+	cfg, err := s.activeConfig()
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, 0600, func(w io.Writer) error {
+		return migp.WriteSnapshot(w, cfg, s.kv.ForEach)
+	})
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/store"
+)
+
+// TestWriteSnapshot answers a query from a snapshot of the server's store
+func TestWriteSnapshot(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), store.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.insert([]byte("username1"), []byte("password1"), ingestOptions{phaseNum: 1, metadata: []byte("snapshot")}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "migp.snapshot")
+	if err := s.writeSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := migp.OpenSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+
+	client, err := migp.NewClient(snapshot.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, reqContext, err := client.Request([]byte("username1"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := s.migpServer.HandleRequest(request, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, metadata, err := reqContext.Finalize(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != migp.InBreach || string(metadata) != "snapshot" {
+		t.Fatalf("want %s %q, got %s %q", migp.InBreach, "snapshot", status, metadata)
+	}
+}
@@ -6,5 +6,6 @@ require (
 	github.com/cloudflare/circl v1.1.1-0.20211202201456-cd788e30354b
 	github.com/lib/pq v1.10.9
 	github.com/spaolacci/murmur3 v1.1.0
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
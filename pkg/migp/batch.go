@@ -0,0 +1,106 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// MaxBatchSize is the maximum number of requests a server handles in a single
+// batch
+const MaxBatchSize = 1000
+
+// ErrBatchTooLarge is returned for batches of more than MaxBatchSize requests
+var ErrBatchTooLarge = errors.New("too many requests in batch")
+
+// ErrInternal is reported to clients in place of the errors of batched
+// requests that failed for reasons other than the request itself
+var ErrInternal = errors.New("internal error")
+
+// BatchRequest carries several client requests, each for its own bucket, to
+// be handled in a single round trip
+type BatchRequest struct {
+	Version  uint32          `json:"version"`
+	Requests []ClientRequest `json:"requests"`
+}
+
+// BatchResponseItem is the server's response to a single request in a batch.
+// Response holds the binary encoding of the ServerResponse, and Error is set
+// instead if the request failed. Error only gives the detail of errors caused
+// by the request; other failures read as ErrInternal, and their error is kept
+// in Internal for the server to log, but not sent.
+type BatchResponseItem struct {
+	Response []byte `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Internal error  `json:"-"`
+}
+
+// BatchResponse carries the responses to a batch request, in request order
+type BatchResponse struct {
+	Version uint32              `json:"version"`
+	Items   []BatchResponseItem `json:"items"`
+}
+
+// Credential is a username and password pair to query
+type Credential struct {
+	Username []byte
+	Password []byte
+}
+
+// BatchResult is the outcome of a single query in a batch. Err is set if the
+// query failed, in which case Status and Metadata are unset.
+type BatchResult struct {
+	Status   BreachStatus
+	Metadata []byte
+	Err      error
+}
+
+// HandleBatchRequest handles each request in a batch as HandleRequest does.
+// Failures of individual requests are reported in their response items; an
+// error is only returned if the batch as a whole is invalid.
+func (s *Server) HandleBatchRequest(batch BatchRequest, kv Getter) (BatchResponse, error) {
+	if uint16(batch.Version) != s.version {
+		return BatchResponse{}, fmt.Errorf("%w: requested version doesn't match server version", ErrVersionMismatch)
+	}
+	if len(batch.Requests) > MaxBatchSize {
+		return BatchResponse{}, fmt.Errorf("%w: %d requests", ErrBatchTooLarge, len(batch.Requests))
+	}
+
+	response := BatchResponse{
+		Version: batch.Version,
+		Items:   make([]BatchResponseItem, len(batch.Requests)),
+	}
+	for i, request := range batch.Requests {
+		item, err := s.HandleRequest(request, kv)
+		if err == nil {
+			response.Items[i].Response, err = item.MarshalBinary()
+		}
+		if err != nil {
+			response.Items[i] = batchErrorItem(err)
+		}
+	}
+	return response, nil
+}
+
+// batchErrorItem returns the response item for a batched request that failed
+// with err
+func batchErrorItem(err error) BatchResponseItem {
+	for _, clientErr := range []error{ErrVersionMismatch, ErrInvalidBucketID, ErrMalformedElement, ErrUnknownEpoch} {
+		if errors.Is(err, clientErr) {
+			return BatchResponseItem{Error: err.Error()}
+		}
+	}
+	return BatchResponseItem{Error: ErrInternal.Error(), Internal: err}
+}
+
+// QueryBatch submits queries for several credentials to the batch endpoint
+// of the target MIGP server in a single HTTP request, as HTTPClient.QueryBatch
+// does.
+func (c *Client) QueryBatch(targetURL string, credentials []Credential) ([]BatchResult, error) {
+	httpClient := newHTTPClient(c)
+	httpClient.batchURL = targetURL
+	return httpClient.QueryBatch(context.Background(), credentials)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// failingGetter is a Getter whose every read fails
+type failingGetter struct{}
+
+func (failingGetter) Get(id string) ([]byte, error) {
+	return nil, errors.New("pq: connection to 10.0.0.1 refused")
+}
+
+// TestHandleBatchRequest checks that each request in a batch is answered in
+// order, and that failing requests don't fail the batch
+func TestHandleBatchRequest(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: make(map[string][]byte)}
+	username, password := []byte("test@mail.com"), []byte("password1234")
+	newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, []byte("breach"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.store[server.BucketKey(username)] = newEntry
+
+	client, err := NewClient(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := BatchRequest{Version: DefaultMIGPVersion}
+	var contexts []ClientRequestContext
+	for _, credential := range []Credential{
+		{username, password},
+		{username, []byte("not breached")},
+		{[]byte("bad bucket"), password},
+	} {
+		request, context, err := client.Request(credential.Username, credential.Password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch.Requests = append(batch.Requests, request)
+		contexts = append(contexts, context)
+	}
+	batch.Requests[2].BucketID = "not hex"
+
+	response, err := server.HandleBatchRequest(batch, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Items) != 3 {
+		t.Fatalf("want 3 items, got %d", len(response.Items))
+	}
+	for i, want := range []BreachStatus{InBreach, NotInBreach} {
+		if response.Items[i].Error != "" {
+			t.Fatalf("item %d: unexpected error %s", i, response.Items[i].Error)
+		}
+		serverResponse, err := contexts[i].ParseResponse(response.Items[i].Response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _, err := contexts[i].Finalize(serverResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != want {
+			t.Errorf("item %d: want %s, got %s", i, want, status)
+		}
+	}
+	if !strings.Contains(response.Items[2].Error, ErrInvalidBucketID.Error()) || response.Items[2].Response != nil || response.Items[2].Internal != nil {
+		t.Errorf("item 2: expected invalid bucket ID error, got %+v", response.Items[2])
+	}
+
+	// store failures are reported without their detail
+	response, err = server.HandleBatchRequest(batch, failingGetter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := response.Items[0]
+	if item.Error != ErrInternal.Error() || item.Internal == nil || !strings.Contains(item.Internal.Error(), "connection") {
+		t.Errorf("item 0: expected internal error, got %+v", item)
+	}
+	if !strings.Contains(response.Items[2].Error, ErrInvalidBucketID.Error()) {
+		t.Errorf("item 2: expected invalid bucket ID error, got %+v", response.Items[2])
+	}
+
+	// invalid batches fail as a whole
+	if _, err := server.HandleBatchRequest(BatchRequest{Version: DefaultMIGPVersion + 1}, kv); err == nil {
+		t.Error("expected error for version mismatch")
+	}
+	batch.Requests = make([]ClientRequest, MaxBatchSize+1)
+	if _, err := server.HandleBatchRequest(batch, kv); err == nil {
+		t.Error("expected error for oversized batch")
+	}
+}
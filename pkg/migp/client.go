@@ -5,11 +5,12 @@ package migp
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"io"
+	"math"
 
 	"github.com/cloudflare/circl/oprf"
 )
@@ -23,14 +24,104 @@ type Client struct {
 	slowHasher      SlowHasher
 	oprfClient      *oprf.Client
 	oprfSuite       oprf.SuiteID
+	oprfMode        oprf.Mode
+	publicInput     uint8
+	epoch           uint32
 }
 
 // ClientRequest carries the information the server needs to perform an
-// evaluation
+// evaluation. Epoch selects the server key the evaluation is made with.
+// BlindElements holds additional blinded elements for the same bucket, which
+// the server evaluates together with BlindElement.
 type ClientRequest struct {
-	Version      uint32 `json:"version"`
-	BucketID     string `json:"bucketID"`
-	BlindElement []byte `json:"blindElement"`
+	Version       uint32   `json:"version"`
+	BucketID      string   `json:"bucketID"`
+	Epoch         uint32   `json:"epoch"`
+	BlindElement  []byte   `json:"blindElement"`
+	BlindElements [][]byte `json:"blindElements,omitempty"`
+}
+
+// MarshalBinary marshals the client request in the following binary format:
+// <8-bit encoding version>|<32-bit version>|<32-bit bucket ID>|<32-bit epoch>|
+// <8-bit element count>|<elements>
+// where each blinded element, BlindElement first, is prefixed with its 16-bit
+// length.
+func (r *ClientRequest) MarshalBinary() ([]byte, error) {
+	bucketID, err := BucketIDFromHex(r.BucketID)
+	if err != nil {
+		return nil, err
+	}
+	elements := append([][]byte{r.BlindElement}, r.BlindElements...)
+	if len(elements) > math.MaxUint8 {
+		return nil, errors.New("too many blinded elements to serialize")
+	}
+
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte(ClientRequestEncodingV1)
+	for _, v := range []uint32{r.Version, bucketID, r.Epoch} {
+		if err := binary.Write(buffer, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	buffer.WriteByte(uint8(len(elements)))
+	for _, element := range elements {
+		if len(element) > math.MaxUint16 {
+			return nil, errors.New("blinded element too long to serialize")
+		}
+		if err := binary.Write(buffer, binary.BigEndian, uint16(len(element))); err != nil {
+			return nil, err
+		}
+		buffer.Write(element)
+	}
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary unmarshals a client request from the binary format written
+// by MarshalBinary
+func (r *ClientRequest) UnmarshalBinary(data []byte) error {
+	buffer := bytes.NewReader(data)
+	encoding, err := buffer.ReadByte()
+	if err != nil {
+		return err
+	}
+	if encoding != ClientRequestEncodingV1 {
+		return fmt.Errorf("unsupported client request encoding: %d", encoding)
+	}
+	var header struct {
+		Version, BucketID, Epoch uint32
+		Elements                 uint8
+	}
+	if err := binary.Read(buffer, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if header.Elements < 1 {
+		return errors.New("client request without blinded elements")
+	}
+	elements := make([][]byte, header.Elements)
+	for i := range elements {
+		var length uint16
+		if err := binary.Read(buffer, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		elements[i] = make([]byte, length)
+		if _, err := io.ReadFull(buffer, elements[i]); err != nil {
+			return err
+		}
+	}
+	if buffer.Len() != 0 {
+		return errors.New("trailing bytes after client request")
+	}
+
+	*r = ClientRequest{
+		Version:      header.Version,
+		BucketID:     BucketIDToHex(header.BucketID),
+		Epoch:        header.Epoch,
+		BlindElement: elements[0],
+	}
+	if len(elements) > 1 {
+		r.BlindElements = elements[1:]
+	}
+	return nil
 }
 
 // ClientRequestContext wraps the context needed to process MIGP responses
@@ -39,6 +130,7 @@ type ClientRequest struct {
 type ClientRequestContext struct {
 	client      Client
 	oprfRequest *oprf.ClientRequest
+	info        []byte
 }
 
 func NewClient(cfg Config) (*Client, error) {
@@ -53,7 +145,7 @@ func NewClient(cfg Config) (*Client, error) {
 		return nil, err
 	}
 
-	c.slowHasher, err = NewSlowHasher(cfg.SlowHasherID)
+	c.slowHasher, err = NewSlowHasher(cfg.SlowHasherID, cfg.SlowHashParams)
 	if err != nil {
 		return nil, err
 	}
@@ -63,8 +155,32 @@ func NewClient(cfg Config) (*Client, error) {
 		return nil, err
 	}
 
+	if err := validatePublicInput(cfg.PublicInput); err != nil {
+		return nil, err
+	}
+	c.publicInput = cfg.PublicInput
+	c.epoch = cfg.Epoch
+
+	if _, _, err := oprfSizes(cfg.OPRFSuite); err != nil {
+		return nil, err
+	}
 	c.oprfSuite = cfg.OPRFSuite
-	c.oprfClient, err = oprf.NewClient(c.oprfSuite)
+	c.oprfMode = cfg.OPRFMode
+	switch c.oprfMode {
+	case oprf.BaseMode:
+		c.oprfClient, err = oprf.NewClient(c.oprfSuite)
+	case oprf.VerifiableMode:
+		if len(cfg.PublicKey) == 0 {
+			return nil, errors.New("verifiable OPRF mode requires a server public key")
+		}
+		publicKey := new(oprf.PublicKey)
+		if err := publicKey.Deserialize(c.oprfSuite, cfg.PublicKey); err != nil {
+			return nil, err
+		}
+		c.oprfClient, err = oprf.NewVerifiableClient(c.oprfSuite, publicKey)
+	default:
+		err = errors.New("unsupported OPRF mode")
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -73,126 +189,251 @@ func NewClient(cfg Config) (*Client, error) {
 
 // BucketID returns the bucket ID for the given username
 func (c *Client) BucketID(username []byte) uint32 {
-	return bucketHashToID(c.bucketHasher.Hash(username), c.bucketIDBitSize)
+	return BucketHashToID(c.bucketHasher.Hash(username), c.bucketIDBitSize)
 }
 
 // Request generates a client request byte string and a ClientRequest struct,
 // given a username and password
 func (c Client) Request(username, password []byte) (ClientRequest, ClientRequestContext, error) {
-	input := c.slowHasher.Hash(serializeUsernamePassword(username, password))
+	return c.request(username, [][]byte{password})
+}
+
+// RequestCombined generates a client request that checks a username and
+// password and the username alone in a single round trip. Finalize the
+// response with FinalizeCombined.
+func (c Client) RequestCombined(username, password []byte) (ClientRequest, ClientRequestContext, error) {
+	return c.request(username, [][]byte{password, nil})
+}
 
-	oprfRequest, err := c.oprfClient.Request([][]byte{input})
+// request generates a client request blinding the given username with each
+// of the passwords, the first of which goes in BlindElement
+func (c Client) request(username []byte, passwords [][]byte) (ClientRequest, ClientRequestContext, error) {
+	inputs := make([][]byte, len(passwords))
+	for i, password := range passwords {
+		inputs[i] = c.slowHasher.Hash(serializeUsernamePassword(username, password))
+	}
+
+	oprfRequest, err := c.oprfClient.Request(inputs)
 	if err != nil {
 		return ClientRequest{}, ClientRequestContext{}, err
 	}
 	blindedElements := oprfRequest.BlindedElements()
-	if len(blindedElements) < 1 {
+	if len(blindedElements) != len(inputs) {
 		return ClientRequest{}, ClientRequestContext{}, errors.New("invalid BlindedElements response")
 	}
 
+	bucketID := c.BucketID(username)
 	request := ClientRequest{
 		Version:      uint32(c.version),
-		BucketID:     BucketIDToHex(c.BucketID(username)),
+		BucketID:     BucketIDToHex(bucketID),
+		Epoch:        c.epoch,
 		BlindElement: blindedElements[0],
 	}
+	if len(blindedElements) > 1 {
+		request.BlindElements = blindedElements[1:]
+	}
 	context := ClientRequestContext{
 		client:      c,
 		oprfRequest: oprfRequest,
+		info:        evaluationInfo(c.publicInput, bucketID, c.epoch),
 	}
 
 	return request, context, nil
 }
 
+// ParseResponse unmarshals a binary server response for the client's OPRF
+// suite and mode
+func (c *Client) ParseResponse(data []byte) (ServerResponse, error) {
+	return ParseServerResponse(data, c.oprfSuite, c.oprfMode, 1)
+}
+
+// ParseResponse unmarshals a binary server response to the request, which
+// holds an evaluated element for each blinded element in the request
+func (ctx ClientRequestContext) ParseResponse(data []byte) (ServerResponse, error) {
+	return ParseServerResponse(data, ctx.client.oprfSuite, ctx.client.oprfMode, len(ctx.oprfRequest.BlindedElements()))
+}
+
+// BucketMatch is a bucket entry whose key check matched the queried
+// credentials
+type BucketMatch struct {
+	Flag     MetadataType
+	Metadata []byte
+}
+
+// Status returns the breach status indicated by the matching entry
+func (m BucketMatch) Status() BreachStatus {
+	return m.Flag.ToBreachStatus()
+}
+
 // Finalize parses a response message from server, completes the computation of
 // the OPRF value, determines if it is in the received bucket, and decrypts the
-// associated ciphertext
+// associated ciphertext. In verifiable mode, it returns ErrInvalidProof if the
+// evaluation proof is missing or does not verify against the server's public
+// key. If several entries match, only the first is reported; use FinalizeAll
+// to get all of them.
 func (ctx ClientRequestContext) Finalize(response ServerResponse) (BreachStatus, []byte, error) {
+	secrets, err := ctx.finalizeSecrets(response)
+	if err != nil {
+		return NotInBreach, nil, err
+	}
+	matches, err := ctx.client.matchBucket(secrets[0], response.BucketContents, false)
+	if err != nil || len(matches) == 0 {
+		return NotInBreach, nil, err
+	}
+	return matches[0].Status(), matches[0].Metadata, nil
+}
+
+// FinalizeAll is like Finalize, but walks the whole bucket and returns every
+// matching entry in bucket order, e.g. when the same credentials appear in
+// several breaches with different metadata. It returns no matches if the
+// credentials are not in the bucket.
+func (ctx ClientRequestContext) FinalizeAll(response ServerResponse) ([]BucketMatch, error) {
+	secrets, err := ctx.finalizeSecrets(response)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.client.matchBucket(secrets[0], response.BucketContents, true)
+}
+
+// CombinedResult is the outcome of a combined request. Status is the
+// strongest breach status among all matching entries, and Metadata is the
+// metadata of the first entry with that status. Matches holds every matching
+// entry, for the credentials first and then for the username alone.
+type CombinedResult struct {
+	Status   BreachStatus
+	Metadata []byte
+	Matches  []BucketMatch
+}
+
+// FinalizeCombined finalizes the response to a request from RequestCombined,
+// matching the bucket against every evaluated element
+func (ctx ClientRequestContext) FinalizeCombined(response ServerResponse) (CombinedResult, error) {
+	secrets, err := ctx.finalizeSecrets(response)
+	if err != nil {
+		return CombinedResult{}, err
+	}
+	var result CombinedResult
+	for _, secret := range secrets {
+		matches, err := ctx.client.matchBucket(secret, response.BucketContents, true)
+		if err != nil {
+			return CombinedResult{}, err
+		}
+		result.Matches = append(result.Matches, matches...)
+	}
+	for _, match := range result.Matches {
+		if match.Status().Stronger(result.Status) {
+			result.Status = match.Status()
+			result.Metadata = match.Metadata
+		}
+	}
+	return result, nil
+}
+
+// finalizeSecrets completes the computation of the OPRF values from a server
+// response, one for each blinded element in the request, verifying the
+// evaluation proof in verifiable mode
+func (ctx ClientRequestContext) finalizeSecrets(response ServerResponse) ([][]byte, error) {
 	if uint16(response.Version) != ctx.client.version {
-		return NotInBreach, nil, errors.New("wrong version in reply")
+		return nil, fmt.Errorf("%w: wrong version in reply", ErrVersionMismatch)
 	}
 
-	oprfOutput, err := ctx.client.oprfClient.Finalize(ctx.oprfRequest, &oprf.Evaluation{
+	evaluation := &oprf.Evaluation{
 		Elements: []oprf.SerializedElement{response.EvaluatedElement},
-	}, OprfInfo)
+	}
+	evaluation.Elements = append(evaluation.Elements, response.EvaluatedElements...)
+	if len(evaluation.Elements) != len(ctx.oprfRequest.BlindedElements()) {
+		return nil, fmt.Errorf("%w: wrong number of evaluated elements in reply", ErrMalformedElement)
+	}
+	verifiable := ctx.client.oprfMode == oprf.VerifiableMode
+	if verifiable {
+		proof, err := unmarshalProof(ctx.client.oprfSuite, response.Proof)
+		if err != nil {
+			return nil, err
+		}
+		evaluation.Proof = proof
+	}
+
+	oprfOutput, err := ctx.client.oprfClient.Finalize(ctx.oprfRequest, evaluation, ctx.info)
 	if err != nil {
-		return NotInBreach, nil, err
+		if verifiable {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidProof, err)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrMalformedElement, err)
 	}
-	if len(oprfOutput) < 1 {
-		return NotInBreach, nil, errors.New("invalid Finalize response")
+	if len(oprfOutput) != len(evaluation.Elements) {
+		return nil, errors.New("invalid Finalize response")
 	}
-	secret := oprfOutput[0]
+	return oprfOutput, nil
+}
 
+// matchBucket decrypts the entries of a bucket whose key check matches
+// secret. Unless all is set, it stops at the first match.
+func (c Client) matchBucket(secret, contents []byte, all bool) ([]BucketMatch, error) {
+	var matches []BucketMatch
 	offset := 0
 
 	for {
-		if (offset + HeaderSize) > len(response.BucketContents) {
+		if (offset + HeaderSize) > len(contents) {
 			// Note(caw): we could return an error here, but bail out to the default case
 			break
 		}
 
-		valid, flag, bodyLength, err := ctx.client.bucketEncryptor.DecryptHeader(secret, response.BucketContents[offset:])
+		valid, flag, bodyLength, err := c.bucketEncryptor.DecryptHeader(secret, contents[offset:])
 		if err != nil {
-			return NotInBreach, nil, err
+			return nil, err
 		}
 		offset += HeaderSize
-		if offset+bodyLength > len(response.BucketContents) {
-			return NotInBreach, nil, errors.New("parsing error in bucket")
+		if offset+bodyLength > len(contents) {
+			return nil, errors.New("parsing error in bucket")
 		}
 		if valid {
-			metadata, err := ctx.client.bucketEncryptor.DecryptBody(secret, response.BucketContents[offset:offset+bodyLength])
+			metadata, err := c.bucketEncryptor.DecryptBody(secret, contents[offset:offset+bodyLength])
 			if err != nil {
-				return NotInBreach, nil, err
+				return nil, err
+			}
+			matches = append(matches, BucketMatch{Flag: flag, Metadata: metadata})
+			if !all {
+				break
 			}
-			return flag.ToBreachStatus(), metadata, err
 		}
 
 		// Skip to the next entry
 		offset += bodyLength
 	}
 
-	return NotInBreach, nil, nil
+	return matches, nil
 }
 
-// Query submits a MIGP query to the target MIGP server.
-func Query(cfg Config, targetURL string, username, password []byte) (BreachStatus, []byte, error) {
-	client, err := NewClient(cfg)
+// FinalizeMetadata is like Finalize, but decodes the metadata of the matching
+// entry with ParseMetadata.
+func (ctx ClientRequestContext) FinalizeMetadata(response ServerResponse) (BreachStatus, *Metadata, error) {
+	status, metadata, err := ctx.Finalize(response)
 	if err != nil {
-		return 0, nil, err
-	}
-
-	migpRequest, context, err := client.Request(username, password)
-	if err != nil {
-		return 0, nil, err
-	}
-
-	serializedRequestPayload, err := json.Marshal(migpRequest)
-	if err != nil {
-		return 0, nil, err
+		return status, nil, err
 	}
+	return status, ParseMetadata(metadata), nil
+}
 
-	request, err := http.NewRequest("POST", targetURL, bytes.NewBuffer(serializedRequestPayload))
+// Query submits a MIGP query to the target MIGP server. Use an HTTPClient to
+// make repeated queries.
+func Query(cfg Config, targetURL string, username, password []byte) (BreachStatus, []byte, error) {
+	client, err := NewClient(cfg)
 	if err != nil {
 		return 0, nil, err
 	}
-	request.Header.Set("Content-Type", "application/json")
+	httpClient := newHTTPClient(client)
+	httpClient.evaluateURL = targetURL
+	return httpClient.Query(context.Background(), username, password)
+}
 
-	response, err := http.DefaultClient.Do(request)
-	if err != nil {
-		return 0, nil, err
-	}
-	if response.StatusCode != http.StatusOK {
-		return 0, nil, fmt.Errorf("Request failed with status code %d", response.StatusCode)
-	}
-	defer response.Body.Close()
-	body, err := ioutil.ReadAll(response.Body)
+// QueryCombined submits a combined MIGP query for a username and password and
+// for the username alone to the target MIGP server.
+func QueryCombined(cfg Config, targetURL string, username, password []byte) (CombinedResult, error) {
+	client, err := NewClient(cfg)
 	if err != nil {
-		return 0, nil, err
-	}
-
-	var responsePayload ServerResponse
-	if err := responsePayload.UnmarshalBinary(body); err != nil {
-		return 0, nil, err
+		return CombinedResult{}, err
 	}
-
-	return context.Finalize(responsePayload)
+	httpClient := newHTTPClient(client)
+	httpClient.evaluateURL = targetURL
+	return httpClient.QueryCombined(context.Background(), username, password)
 }
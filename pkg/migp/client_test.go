@@ -5,7 +5,11 @@ package migp
 
 import (
 	"bytes"
+	"errors"
+	"reflect"
 	"testing"
+
+	"github.com/cloudflare/circl/oprf"
 )
 
 // KVMock is a simple KV store implementation
@@ -110,3 +114,570 @@ func TestQuery(t *testing.T) {
 			password, result, NotInBreach)
 	}
 }
+
+// TestQueryVerifiable runs client requests against a server in verifiable
+// OPRF mode, and checks that evaluations with a bad proof or under a
+// different key are rejected
+func TestQueryVerifiable(t *testing.T) {
+	username, password := []byte("test@mail.com"), []byte("password1234")
+	metadata := []byte("my favorite breach")
+
+	serverCfg := DefaultServerConfig()
+	serverCfg.OPRFMode = oprf.VerifiableMode
+	server, err := NewServer(serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv := &KVMock{store: make(map[string][]byte)}
+	newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.store[BucketIDToHex(server.BucketID(username))] = newEntry
+
+	cfg := server.Config().Config
+	if len(cfg.PublicKey) == 0 {
+		t.Fatal("public key missing from verifiable config")
+	}
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, clientFinalize, err := client.Request(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := server.HandleRequest(request, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip through the binary encoding
+	data, err := response.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = client.ParseResponse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, mdString, err := clientFinalize.Finalize(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != InBreach || !bytes.Equal(mdString, metadata) {
+		t.Errorf("got %d '%s' (expected: %d '%s')", result, mdString, InBreach, metadata)
+	}
+
+	// a tampered or missing proof must be rejected
+	tampered := response
+	tampered.Proof = append([]byte{}, response.Proof...)
+	tampered.Proof[len(tampered.Proof)-1] ^= 0x01
+	if _, _, err := clientFinalize.Finalize(tampered); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("tampered proof: got %v, expected %v", err, ErrInvalidProof)
+	}
+	tampered.Proof = nil
+	if _, _, err := clientFinalize.Finalize(tampered); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("missing proof: got %v, expected %v", err, ErrInvalidProof)
+	}
+
+	// a server evaluating under a different key must be rejected
+	otherCfg := DefaultServerConfig()
+	otherCfg.OPRFMode = oprf.VerifiableMode
+	otherServer, err := NewServer(otherCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, clientFinalize, err = client.Request(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = otherServer.HandleRequest(request, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := clientFinalize.Finalize(response); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("different key: got %v, expected %v", err, ErrInvalidProof)
+	}
+
+	// a verifiable client can't be created without the server's public key
+	cfg.PublicKey = nil
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("expected error creating verifiable client without public key")
+	}
+}
+
+// TestQueryPublicInput runs client requests against servers that bind the
+// bucket ID and key epoch into evaluations, and checks that evaluations are
+// only usable for the bucket and epoch they were made for
+func TestQueryPublicInput(t *testing.T) {
+	username, password := []byte("test@mail.com"), []byte("password1234")
+	metadata := []byte("my favorite breach")
+
+	for _, mode := range []oprf.Mode{oprf.BaseMode, oprf.VerifiableMode} {
+		for _, publicInput := range []uint8{PublicInputNone, PublicInputBucketID, PublicInputEpoch, PublicInputBucketID | PublicInputEpoch} {
+			serverCfg := DefaultServerConfig()
+			serverCfg.OPRFMode = mode
+			serverCfg.PublicInput = publicInput
+			serverCfg.Epoch = 7
+			server, err := NewServer(serverCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bucketIDHex := BucketIDToHex(server.BucketID(username))
+			newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kv := &KVMock{store: map[string][]byte{bucketIDHex: newEntry}}
+
+			query := func(cfg Config, bucketIDHex string) BreachStatus {
+				client, err := NewClient(cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				request, clientFinalize, err := client.Request(username, password)
+				if err != nil {
+					t.Fatal(err)
+				}
+				request.BucketID = bucketIDHex
+				// evaluate under the server's only key, even for a
+				// client in another epoch
+				request.Epoch = serverCfg.Epoch
+				response, err := server.HandleRequest(request, kv)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// serve the real bucket regardless of the requested ID
+				response.BucketContents = kv.store[BucketIDToHex(client.BucketID(username))]
+				result, _, err := clientFinalize.Finalize(response)
+				if err != nil && !errors.Is(err, ErrInvalidProof) {
+					t.Fatal(err)
+				}
+				return result
+			}
+
+			cfg := server.Config().Config
+			if result := query(cfg, bucketIDHex); result != InBreach {
+				t.Errorf("mode %d, public input %d: got %d, expected %d", mode, publicInput, result, InBreach)
+			}
+
+			// an evaluation made for another bucket must not match
+			otherBucketIDHex := BucketIDToHex(server.BucketID(username) ^ 1)
+			expected := InBreach
+			if publicInput&PublicInputBucketID != 0 {
+				expected = NotInBreach
+			}
+			if result := query(cfg, otherBucketIDHex); result != expected {
+				t.Errorf("mode %d, public input %d, other bucket: got %d, expected %d", mode, publicInput, result, expected)
+			}
+
+			// a client in another epoch must not match
+			cfg.Epoch++
+			expected = InBreach
+			if publicInput&PublicInputEpoch != 0 {
+				expected = NotInBreach
+			}
+			if result := query(cfg, bucketIDHex); result != expected {
+				t.Errorf("mode %d, public input %d, other epoch: got %d, expected %d", mode, publicInput, result, expected)
+			}
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.PublicInput = 0x80
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("expected error for unsupported public input")
+	}
+}
+
+// TestQueryEpochs runs client requests against a server in the middle of a
+// key rotation, which answers queries for both the current and the previous
+// key epoch
+func TestQueryEpochs(t *testing.T) {
+	username, password := []byte("test@mail.com"), []byte("password1234")
+	metadata := []byte("my favorite breach")
+
+	for _, mode := range []oprf.Mode{oprf.BaseMode, oprf.VerifiableMode} {
+		oldCfg := DefaultServerConfig()
+		oldCfg.OPRFMode = mode
+		oldServer, err := NewServer(oldCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		newCfg := DefaultServerConfig()
+		newCfg.OPRFMode = mode
+		newCfg.Epoch = oldCfg.Epoch + 1
+		newCfg.PreviousPrivateKey = oldCfg.PrivateKey
+		server, err := NewServer(newCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the same credential, stored once under each epoch's key
+		kv := &KVMock{store: make(map[string][]byte)}
+		for _, s := range []*Server{oldServer, server} {
+			newEntry, err := s.EncryptBucketEntry(username, password, MetadataBreachedPassword, metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kv.store[s.BucketKey(username)] = newEntry
+		}
+		if len(kv.store) != 2 {
+			t.Fatalf("expected a bucket per epoch, got %d buckets", len(kv.store))
+		}
+
+		for _, epoch := range []uint32{oldCfg.Epoch, newCfg.Epoch} {
+			cfg, err := server.EpochConfig(epoch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := NewClient(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request, clientFinalize, err := client.Request(username, password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := server.HandleRequest(request, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, mdString, err := clientFinalize.Finalize(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != InBreach || !bytes.Equal(mdString, metadata) {
+				t.Errorf("mode %d, epoch %d: got %d '%s' (expected: %d '%s')", mode, epoch, result, mdString, InBreach, metadata)
+			}
+		}
+
+		if _, err := server.EpochConfig(newCfg.Epoch + 1); err == nil {
+			t.Error("expected error for config of unknown epoch")
+		}
+		client, err := NewClient(server.Config().Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, _, err := client.Request(username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Epoch = newCfg.Epoch + 1
+		if _, err := server.HandleRequest(request, kv); err == nil {
+			t.Error("expected error for request in unknown epoch")
+		}
+	}
+}
+
+// TestQuerySuites runs client requests through the binary response encoding
+// for each supported OPRF suite and mode, and each bucket encryptor
+func TestQuerySuites(t *testing.T) {
+	username, password := []byte("test@mail.com"), []byte("password1234")
+	metadata := []byte("my favorite breach")
+
+	for _, suite := range OPRFSuites {
+		for _, mode := range []oprf.Mode{oprf.BaseMode, oprf.VerifiableMode} {
+			for _, encryptorID := range []uint16{BucketEncryptorHKDFSHA256, BucketEncryptorAES256GCM} {
+				cfg := DefaultConfig()
+				cfg.OPRFSuite = suite
+				cfg.OPRFMode = mode
+				cfg.BucketEncryptorID = encryptorID
+				serverCfg, err := NewServerConfig(cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				server, err := NewServer(serverCfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, metadata)
+				if err != nil {
+					t.Fatal(err)
+				}
+				kv := &KVMock{store: map[string][]byte{server.BucketKey(username): newEntry}}
+
+				client, err := NewClient(server.Config().Config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				request, clientFinalize, err := client.Request(username, password)
+				if err != nil {
+					t.Fatal(err)
+				}
+				response, err := server.HandleRequest(request, kv)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := response.MarshalBinary()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if response, err = client.ParseResponse(data); err != nil {
+					t.Fatal(err)
+				}
+				result, mdString, err := clientFinalize.Finalize(response)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result != InBreach || !bytes.Equal(mdString, metadata) {
+					t.Errorf("suite %d, mode %d, encryptor %d: got %d '%s' (expected: %d '%s')",
+						suite, mode, encryptorID, result, mdString, InBreach, metadata)
+				}
+			}
+		}
+	}
+}
+
+// TestFinalizeAll stores the same credentials several times with different
+// metadata and checks that every matching entry is reported, while Finalize
+// keeps reporting the first
+func TestFinalizeAll(t *testing.T) {
+	username, password := []byte("test@mail.com"), []byte("password1234")
+
+	for _, encryptorID := range []uint16{BucketEncryptorHKDFSHA256, BucketEncryptorAES256GCM} {
+		serverCfg := DefaultServerConfig()
+		serverCfg.BucketEncryptorID = encryptorID
+		serverCfg.Padding = PaddingConfig{Policy: PaddingFixed, Entries: 8}
+		server, err := NewServer(serverCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries := []struct {
+			username, password []byte
+			flag               MetadataType
+			metadata           []byte
+		}{
+			{username, password, MetadataBreachedPassword, []byte("first breach")},
+			{username, nil, MetadataBreachedUsername, []byte("first breach")},
+			{[]byte("other@mail.com"), password, MetadataBreachedPassword, []byte("other breach")},
+			{username, password, MetadataBreachedPassword, []byte("second breach")},
+			{username, password, MetadataSimilarPassword, nil},
+		}
+		kv := &KVMock{store: make(map[string][]byte)}
+		bucketKey := server.BucketKey(username)
+		for _, entry := range entries {
+			newEntry, err := server.EncryptBucketEntry(entry.username, entry.password, entry.flag, entry.metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kv.store[bucketKey] = append(kv.store[bucketKey], newEntry...)
+		}
+
+		client, err := NewClient(server.Config().Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, context, err := client.Request(username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := server.HandleRequest(request, kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matches, err := context.FinalizeAll(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]BreachStatus{"first breach": InBreach, "second breach": InBreach, "": SimilarInBreach}
+		if len(matches) != len(want) {
+			t.Fatalf("encryptor %d: want %d matches, got %d", encryptorID, len(want), len(matches))
+		}
+		for _, match := range matches {
+			status, ok := want[string(match.Metadata)]
+			if !ok || match.Status() != status {
+				t.Errorf("encryptor %d: unexpected match %s %q", encryptorID, match.Status(), match.Metadata)
+			}
+			delete(want, string(match.Metadata))
+		}
+
+		status, metadata, err := context.Finalize(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != matches[0].Status() || !bytes.Equal(metadata, matches[0].Metadata) {
+			t.Errorf("encryptor %d: Finalize got %s %q, want first match %s %q", encryptorID, status, metadata, matches[0].Status(), matches[0].Metadata)
+		}
+
+		// credentials that are not in the bucket have no matches
+		request, context, err = client.Request(username, []byte("not breached"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err = server.HandleRequest(request, kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches, err := context.FinalizeAll(response); err != nil || len(matches) != 0 {
+			t.Errorf("encryptor %d: want no matches, got %v %v", encryptorID, matches, err)
+		}
+	}
+}
+
+// TestQueryCombined checks credentials and the username alone in a single
+// request, in both OPRF modes, and checks that the strongest status is
+// reported
+func TestQueryCombined(t *testing.T) {
+	for _, mode := range []oprf.Mode{oprf.BaseMode, oprf.VerifiableMode} {
+		serverCfg := DefaultServerConfig()
+		serverCfg.OPRFMode = mode
+		server, err := NewServer(serverCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kv := &KVMock{store: make(map[string][]byte)}
+		for _, entry := range []struct {
+			username, password string
+			flag               MetadataType
+		}{
+			{"alice", "password1234", MetadataBreachedPassword},
+			{"alice", "", MetadataBreachedUsername},
+			{"bob", "", MetadataBreachedUsername},
+			{"carol", "Password1234", MetadataSimilarPassword},
+		} {
+			var password []byte
+			if entry.password != "" {
+				password = []byte(entry.password)
+			}
+			newEntry, err := server.EncryptBucketEntry([]byte(entry.username), password, entry.flag, []byte(entry.username+" "+entry.flag.String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bucketKey := server.BucketKey([]byte(entry.username))
+			kv.store[bucketKey] = append(kv.store[bucketKey], newEntry...)
+		}
+
+		client, err := NewClient(server.Config().Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCases := []struct {
+			username, password string
+			status             BreachStatus
+			metadata           string
+			matches            int
+		}{
+			{"alice", "password1234", InBreach, "alice breached password", 2},
+			{"alice", "letmein", UsernameInBreach, "alice breached username", 1},
+			{"bob", "password1234", UsernameInBreach, "bob breached username", 1},
+			{"carol", "Password1234", SimilarInBreach, "carol similar password", 1},
+			{"dave", "password1234", NotInBreach, "", 0},
+		}
+		for _, test := range testCases {
+			request, context, err := client.RequestCombined([]byte(test.username), []byte(test.password))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(request.BlindElements) != 1 {
+				t.Fatalf("want 1 additional blinded element, got %d", len(request.BlindElements))
+			}
+			response, err := server.HandleRequest(request, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := response.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response, err = context.ParseResponse(data); err != nil {
+				t.Fatal(err)
+			}
+			result, err := context.FinalizeCombined(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != test.status || string(result.Metadata) != test.metadata || len(result.Matches) != test.matches {
+				t.Errorf("mode %d, %s: want %s %q with %d matches, got %s %q with %d matches", mode, test.username,
+					test.status, test.metadata, test.matches, result.Status, result.Metadata, len(result.Matches))
+			}
+
+			// the credentials alone finalize as with a single-element request
+			status, _, err := context.Finalize(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.status
+			if want == UsernameInBreach {
+				want = NotInBreach
+			}
+			if status != want {
+				t.Errorf("mode %d, %s: credentials alone want %s, got %s", mode, test.username, want, status)
+			}
+		}
+
+		// the server bounds the number of elements it evaluates
+		request, _, err := client.RequestCombined([]byte("alice"), []byte("password1234"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for len(request.BlindElements) < MaxBlindElements {
+			request.BlindElements = append(request.BlindElements, request.BlindElement)
+		}
+		if _, err := server.HandleRequest(request, kv); err == nil {
+			t.Errorf("mode %d: expected error for too many blinded elements", mode)
+		}
+	}
+}
+
+// TestClientRequestSerialization tests the binary encoding of single and
+// multi-element client requests
+func TestClientRequestSerialization(t *testing.T) {
+	client, err := NewClient(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, _, err := client.Request([]byte("username"), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	combined, _, err := client.RequestCombined([]byte("username"), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	combined.Epoch = 7
+
+	for i, r1 := range []ClientRequest{single, combined} {
+		data, err := r1.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r2 ClientRequest
+		if err := r2.UnmarshalBinary(data); err != nil {
+			t.Fatalf("failed test %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(r1, r2) {
+			t.Errorf("failed test %d: want %+v, got %+v", i, r1, r2)
+		}
+
+		// truncated and padded encodings are rejected
+		for _, bad := range [][]byte{data[:len(data)-1], append(data, 0)} {
+			if err := r2.UnmarshalBinary(bad); err == nil {
+				t.Errorf("failed test %d: expected error for %d bytes", i, len(bad))
+			}
+		}
+	}
+
+	bad := single
+	bad.BucketID = "xyz"
+	if _, err := bad.MarshalBinary(); err == nil {
+		t.Error("expected error for invalid bucket ID")
+	}
+	var r ClientRequest
+	if err := r.UnmarshalBinary([]byte{ClientRequestEncodingV1 + 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Error("expected error for unsupported encoding")
+	}
+	if err := r.UnmarshalBinary([]byte{ClientRequestEncodingV1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Error("expected error for request without elements")
+	}
+}
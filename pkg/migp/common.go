@@ -6,6 +6,10 @@ package migp
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/cloudflare/circl/oprf"
 )
@@ -25,6 +29,7 @@ const (
 	DefaultSlowHasher      = SlowHasherScrypt
 	DefaultBucketEncryptor = BucketEncryptorHKDFSHA256
 	DefaultOPRFSuite       = uint16(oprf.OPRFP256)
+	DefaultOPRFMode        = oprf.BaseMode
 
 	// CtxtKeyCheckSize is the size of key check string in bytes. We use this
 	// to check if a given bucket entry header matches the derived key.
@@ -34,20 +39,85 @@ const (
 	// consists of the key check bytes, 1-byte flag, and 4-byte body
 	// length.
 	HeaderSize = CtxtKeyCheckSize + 5
+
+	// MaxBlindElements is the maximum number of blinded elements a server
+	// evaluates for a single request
+	MaxBlindElements = 8
+
+	// ClientRequestEncodingV1 is the first version of the binary encoding
+	// of client requests
+	ClientRequestEncodingV1 = 0x01
+
+	// ContentTypeJSON and ContentTypeBinary are the content types of JSON
+	// and binary encoded client requests
+	ContentTypeJSON   = "application/json"
+	ContentTypeBinary = "application/octet-stream"
+)
+
+// Public inputs that can be bound into OPRF evaluations, making the OPRF
+// partially oblivious. They are bit flags and can be combined.
+const (
+	PublicInputNone     = 0x00
+	PublicInputBucketID = 0x01
+	PublicInputEpoch    = 0x02
 )
 
 var (
 	OprfInfo = []byte("MIGP oprf info")
+
+	// ErrInvalidProof is returned when a verifiable OPRF evaluation comes
+	// with a missing or invalid proof
+	ErrInvalidProof = errors.New("invalid OPRF evaluation proof")
+
+	// ErrVersionMismatch is returned when a request or response carries a
+	// MIGP version other than the expected one
+	ErrVersionMismatch = errors.New("MIGP version mismatch")
+
+	// ErrInvalidBucketID is returned for bucket IDs that are not hex encoded
+	// 32-bit values, or that are out of range for the bucket ID bit size
+	ErrInvalidBucketID = errors.New("invalid bucket ID")
+
+	// ErrMalformedElement is returned when a blinded or evaluated OPRF
+	// element cannot be decoded, or a message carries the wrong number of
+	// elements
+	ErrMalformedElement = errors.New("malformed OPRF element")
+
+	// ErrTruncatedResponse is returned when a server response is too short
+	// to hold its fields
+	ErrTruncatedResponse = errors.New("truncated server response")
+
+	// ErrUnknownEpoch is returned for requests for a key epoch the server
+	// holds no key for
+	ErrUnknownEpoch = errors.New("unknown key epoch")
 )
 
 // Config contains MIGP configuration used both clients and servers.
+//
+// In verifiable OPRF mode (OPRFMode set to oprf.VerifiableMode), the server
+// publishes its serialized public key in PublicKey and attaches a proof to
+// each evaluation, which clients check against PublicKey. This lets a client
+// detect a server that evaluates different users under different keys.
+//
+// PublicInput selects the public inputs bound into each OPRF evaluation in
+// addition to OprfInfo. With PublicInputBucketID, an evaluated element is
+// only valid for the bucket it was requested with. With PublicInputEpoch,
+// evaluations are bound to Epoch, so changing the epoch yields an unrelated
+// set of bucket entries under the same key.
+//
+// SlowHashParams holds the cost parameters and salt of the slow hasher. Zero
+// fields take the slow hasher's defaults.
 type Config struct {
-	Version           uint16       `json:"version"`
-	BucketIDBitSize   int          `json:"bucketIDBitSize"`
-	BucketHasherID    uint16       `json:"bucketHasher"`
-	SlowHasherID      uint16       `json:"slowHasher"`
-	BucketEncryptorID uint16       `json:"bucketEncryptor"`
-	OPRFSuite         oprf.SuiteID `json:"oprfSuite"`
+	Version           uint16         `json:"version"`
+	BucketIDBitSize   int            `json:"bucketIDBitSize"`
+	BucketHasherID    uint16         `json:"bucketHasher"`
+	SlowHasherID      uint16         `json:"slowHasher"`
+	SlowHashParams    SlowHashParams `json:"slowHashParams"`
+	BucketEncryptorID uint16         `json:"bucketEncryptor"`
+	OPRFSuite         oprf.SuiteID   `json:"oprfSuite"`
+	OPRFMode          oprf.Mode      `json:"oprfMode"`
+	PublicKey         []byte         `json:"publicKey,omitempty"`
+	PublicInput       uint8          `json:"publicInput"`
+	Epoch             uint32         `json:"epoch"`
 }
 
 // DefaultConfig returns a new default configuration
@@ -58,10 +128,38 @@ func DefaultConfig() Config {
 		BucketEncryptorID: DefaultBucketEncryptor,
 		SlowHasherID:      DefaultSlowHasher,
 		OPRFSuite:         DefaultOPRFSuite,
+		OPRFMode:          DefaultOPRFMode,
+		PublicInput:       PublicInputNone,
 		BucketIDBitSize:   DefaultBucketIDBitSize,
 	}
 }
 
+// validatePublicInput returns an error if publicInput contains unknown flags
+func validatePublicInput(publicInput uint8) error {
+	if publicInput&^(PublicInputBucketID|PublicInputEpoch) != 0 {
+		return fmt.Errorf("unsupported public input: %#x", publicInput)
+	}
+	return nil
+}
+
+// evaluationInfo returns the OPRF info string for an evaluation in the given
+// bucket and epoch, in the following format:
+// <OprfInfo>|<32-bit bucket ID>|<32-bit epoch>
+// where the bucket ID and epoch are only present if selected by publicInput.
+func evaluationInfo(publicInput uint8, bucketID, epoch uint32) []byte {
+	info := append([]byte{}, OprfInfo...)
+	b := make([]byte, 4)
+	if publicInput&PublicInputBucketID != 0 {
+		binary.BigEndian.PutUint32(b, bucketID)
+		info = append(info, b...)
+	}
+	if publicInput&PublicInputEpoch != 0 {
+		binary.BigEndian.PutUint32(b, epoch)
+		info = append(info, b...)
+	}
+	return info
+}
+
 // Flag represents the type of metadata for a breach item.
 type MetadataType uint8
 
@@ -149,6 +247,27 @@ func (bs BreachStatus) String() string {
 	}
 }
 
+// Stronger reports whether bs is a stronger breach status than other. A
+// breached password is stronger than a similar password, which is stronger
+// than a breached username.
+func (bs BreachStatus) Stronger(other BreachStatus) bool {
+	return bs.strength() > other.strength()
+}
+
+// strength ranks breach statuses for Stronger
+func (bs BreachStatus) strength() int {
+	switch bs {
+	case InBreach:
+		return 3
+	case SimilarInBreach:
+		return 2
+	case UsernameInBreach:
+		return 1
+	default:
+		return 0
+	}
+}
+
 // serializeUsernamePassword generates a byte string consisting of username and
 // password.  We use a simple prefix-free length-based encoding of the username
 // and password, where lengths are encoded as 16-bit big-endian unsigned
@@ -165,9 +284,9 @@ func serializeUsernamePassword(username, password []byte) []byte {
 	return buf
 }
 
-// bucketHashToID returns a uint32 bucket ID given a bucket hash and the bucket
+// BucketHashToID returns a uint32 bucket ID given a bucket hash and the bucket
 // ID bit size
-func bucketHashToID(bucketHash []byte, bitSize int) uint32 {
+func BucketHashToID(bucketHash []byte, bitSize int) uint32 {
 	if bitSize > 32 {
 		panic("Bucket ID bit size cannot be greater than 32")
 	}
@@ -176,9 +295,101 @@ func bucketHashToID(bucketHash []byte, bitSize int) uint32 {
 	return bucketID >> (32 - bitSize) & ((1 << bitSize) - 1)
 }
 
+// OPRFSuites lists the OPRF suites supported by MIGP
+var OPRFSuites = []oprf.SuiteID{oprf.OPRFP256, oprf.OPRFP384, oprf.OPRFP521}
+
+// oprfSizes returns the serialized element and scalar lengths for the given
+// OPRF suite. Unlike oprf.GetSizes, which reports zero lengths for suites it
+// doesn't know, it returns oprf.ErrUnsupportedSuite for those.
+func oprfSizes(suite oprf.SuiteID) (elementLength, scalarLength int, err error) {
+	sizes, err := oprf.GetSizes(suite)
+	if err != nil {
+		return 0, 0, err
+	}
+	if sizes.SerializedElementLength == 0 || sizes.SerializedScalarLength == 0 {
+		return 0, 0, oprf.ErrUnsupportedSuite
+	}
+	return int(sizes.SerializedElementLength), int(sizes.SerializedScalarLength), nil
+}
+
+// proofLength returns the length of a serialized evaluation proof for the
+// given OPRF suite
+func proofLength(suite oprf.SuiteID) (int, error) {
+	_, scalarLength, err := oprfSizes(suite)
+	if err != nil {
+		return 0, err
+	}
+	return 2 * scalarLength, nil
+}
+
+// marshalProof serializes an evaluation proof as <c>|<s>
+func marshalProof(proof *oprf.Proof) []byte {
+	return append(append([]byte{}, proof.C...), proof.S...)
+}
+
+// unmarshalProof deserializes an evaluation proof serialized with
+// marshalProof
+func unmarshalProof(suite oprf.SuiteID, data []byte) (*oprf.Proof, error) {
+	length, err := proofLength(suite)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != length {
+		return nil, ErrInvalidProof
+	}
+	return &oprf.Proof{
+		C: data[:length/2],
+		S: data[length/2:],
+	}, nil
+}
+
 // BucketIDToHex encodes a uint32 bucket ID to a hex string
 func BucketIDToHex(bucketID uint32) string {
 	b := make([]byte, 4)
 	binary.BigEndian.PutUint32(b[0:], bucketID)
 	return hex.EncodeToString(b)
 }
+
+// BucketKey returns the storage key for the bucket with the given hex-encoded
+// ID in the given key epoch. Buckets in epoch zero are stored under their
+// bare ID, so stores populated before key epochs were introduced remain
+// valid.
+func BucketKey(epoch uint32, bucketIDHex string) string {
+	if epoch == 0 {
+		return bucketIDHex
+	}
+	return fmt.Sprintf("%d/%s", epoch, bucketIDHex)
+}
+
+// ParseBucketKey splits a storage key produced by BucketKey into its key
+// epoch and hex-encoded bucket ID
+func ParseBucketKey(key string) (uint32, string, error) {
+	epoch, bucketIDHex := uint64(0), key
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		var err error
+		if epoch, err = strconv.ParseUint(key[:i], 10, 32); err != nil || epoch == 0 {
+			return 0, "", fmt.Errorf("%w: bad epoch in bucket key %q", ErrInvalidBucketID, key)
+		}
+		bucketIDHex = key[i+1:]
+	}
+	bucketID, err := BucketIDFromHex(bucketIDHex)
+	if err != nil {
+		return 0, "", err
+	}
+	if BucketKey(uint32(epoch), BucketIDToHex(bucketID)) != key {
+		return 0, "", fmt.Errorf("%w: bucket key %q not in canonical form", ErrInvalidBucketID, key)
+	}
+	return uint32(epoch), bucketIDHex, nil
+}
+
+// BucketIDFromHex decodes a bucket ID hex string produced by BucketIDToHex
+func BucketIDFromHex(bucketIDHex string) (uint32, error) {
+	b, err := hex.DecodeString(bucketIDHex)
+	if err != nil {
+		return 0, fmt.Errorf("%w: not valid hex", ErrInvalidBucketID)
+	}
+	if len(b) != 4 {
+		return 0, fmt.Errorf("%w: wrong length", ErrInvalidBucketID)
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
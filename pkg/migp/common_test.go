@@ -34,7 +34,7 @@ func TestBucketHashToID(t *testing.T) {
 		{[]byte{1, 2, 3, 4, 5, 6}, 32, 0x1020304},
 	}
 	for i, test := range tests {
-		result := bucketHashToID(test.hash, test.bitSize)
+		result := BucketHashToID(test.hash, test.bitSize)
 		if result != test.out {
 			t.Errorf("failed test %d: want %d, got %d", i, test.out, result)
 		}
@@ -57,3 +57,31 @@ func TestBucketIDToHex(t *testing.T) {
 		}
 	}
 }
+
+func TestParseBucketKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		epoch uint32
+		hex   string
+		ok    bool
+	}{
+		{"000000ff", 0, "000000ff", true},
+		{"3/01020304", 3, "01020304", true},
+		{"0/01020304", 0, "", false},
+		{"03/01020304", 0, "", false},
+		{"x/01020304", 0, "", false},
+		{"3/0102030", 0, "", false},
+		{"000000FF", 0, "", false},
+		{"3/01020304/", 0, "", false},
+	}
+	for i, test := range tests {
+		epoch, bucketIDHex, err := ParseBucketKey(test.key)
+		if (err == nil) != test.ok {
+			t.Errorf("failed test %d: unexpected error %v", i, err)
+			continue
+		}
+		if test.ok && (epoch != test.epoch || bucketIDHex != test.hex || BucketKey(epoch, bucketIDHex) != test.key) {
+			t.Errorf("failed test %d: want %d %q, got %d %q", i, test.epoch, test.hex, epoch, bucketIDHex)
+		}
+	}
+}
@@ -4,21 +4,35 @@
 package migp
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/binary"
 	"errors"
+	"io"
+	"math"
 
 	"golang.org/x/crypto/hkdf"
 )
 
 const (
 	BucketEncryptorHKDFSHA256 uint16 = 0x0001
+	BucketEncryptorAES256GCM  uint16 = 0x0002
 )
 
 var (
 	DerivePadHeaderSalt = []byte("MIGP derive pad header")
 	DerivePadBodySalt   = []byte("MIGP derive pad body")
+
+	DeriveAEADHeaderSalt   = []byte("MIGP derive AEAD header")
+	DeriveAEADBodyKeySalt  = []byte("MIGP derive AEAD body key")
+	DeriveAEADNonceKeySalt = []byte("MIGP derive AEAD nonce key")
+
+	// ErrBodyAuthentication is returned by DecryptBody when the body of an
+	// authenticated bucket entry fails to authenticate
+	ErrBodyAuthentication = errors.New("bucket entry body failed to authenticate")
 )
 
 // BucketEncryptor is a generic interface for a bucket encryption algorithm.
@@ -46,7 +60,8 @@ func (h hkdfSHA256BucketEncryptor) ID() uint16 {
 // Encrypt encrypts the input (metadataFlag || metadata) using the input secret using
 // a key-committing AEAD based on HKDF-SHA256 key derivation and XOR-based encryption
 // Output format:
-//   XOR(<20-byte all-zero key check> | <1-byte flag>, <headerPad>) | <4-byte body length> | XOR(<body>, <bodyPad>)
+//
+//	XOR(<20-byte all-zero key check> | <1-byte flag>, <headerPad>) | <4-byte body length> | XOR(<body>, <bodyPad>)
 func (h hkdfSHA256BucketEncryptor) Encrypt(secret []byte, flag MetadataType, body []byte) ([]byte, error) {
 
 	headerPad, err := derivePad(secret, DerivePadHeaderSalt, CtxtKeyCheckSize+1)
@@ -111,6 +126,137 @@ func (h hkdfSHA256BucketEncryptor) DecryptBody(secret []byte, ciphertext []byte)
 
 }
 
+// aes256GCMBucketEncryptor implements BucketEncryptor using HKDF-SHA256 key
+// derivation and AES-256-GCM
+type aes256GCMBucketEncryptor struct{}
+
+// NewAES256GCMBucketEncryptor returns a new bucket encryptor that
+// authenticates both the entry header and body. The header carries a
+// 21-byte tag derived with HKDF-SHA256 from the secret and the metadata
+// flag, which commits to the secret and the flag. The body is encrypted with
+// AES-256-GCM under a key derived from the secret, using a synthetic nonce
+// derived from the flag and the body so that encryption stays deterministic.
+func NewAES256GCMBucketEncryptor() aes256GCMBucketEncryptor {
+	return aes256GCMBucketEncryptor{}
+}
+
+// ID returns the aes256GCMBucketEncryptor identifier
+func (h aes256GCMBucketEncryptor) ID() uint16 {
+	return BucketEncryptorAES256GCM
+}
+
+// Encrypt encrypts the input (metadataFlag || metadata) using the input
+// secret. Output format:
+//
+//	<21-byte header tag> | <4-byte body length> | <12-byte nonce> | AES-256-GCM(<body>, aad=<4-byte body length>)
+//
+// where the header tag is HKDF-SHA256(secret, salt=DeriveAEADHeaderSalt,
+// info=flag) and the nonce is the truncated HMAC-SHA256 of flag | body.
+func (h aes256GCMBucketEncryptor) Encrypt(secret []byte, flag MetadataType, body []byte) ([]byte, error) {
+	headerTag, err := deriveAEADHeaderTag(secret, flag)
+	if err != nil {
+		return nil, err
+	}
+	aead, nonceKey, err := deriveAEADBodyKeys(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > math.MaxUint32-aead.NonceSize()-aead.Overhead() {
+		return nil, errors.New("bucket entry body too long")
+	}
+
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write([]byte{byte(flag)})
+	mac.Write(body)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	bodyLength := make([]byte, 4)
+	binary.BigEndian.PutUint32(bodyLength, uint32(aead.NonceSize()+len(body)+aead.Overhead()))
+
+	ciphertext := make([]byte, 0, HeaderSize+aead.NonceSize()+len(body)+aead.Overhead())
+	ciphertext = append(ciphertext, headerTag...)
+	ciphertext = append(ciphertext, bodyLength...)
+	ciphertext = append(ciphertext, nonce...)
+	return aead.Seal(ciphertext, nonce, body, bodyLength), nil
+}
+
+// DecryptHeader checks the header tag against the tags derived from the
+// input secret for each valid metadata flag, and returns the matching flag
+// and the body length
+func (h aes256GCMBucketEncryptor) DecryptHeader(secret []byte, ciphertext []byte) (bool, MetadataType, int, error) {
+	if len(ciphertext) < HeaderSize {
+		return false, 0, 0, errors.New("ciphertext of insufficient length to parse header")
+	}
+
+	// body length is in plaintext, and authenticated by the body
+	bodyLength := int(binary.BigEndian.Uint32(ciphertext[CtxtKeyCheckSize+1 : HeaderSize]))
+
+	for _, flag := range []MetadataType{MetadataDummy, MetadataBreachedPassword, MetadataSimilarPassword, MetadataBreachedUsername} {
+		headerTag, err := deriveAEADHeaderTag(secret, flag)
+		if err != nil {
+			return false, 0, 0, err
+		}
+		if subtle.ConstantTimeCompare(headerTag, ciphertext[:CtxtKeyCheckSize+1]) == 1 {
+			return true, flag, bodyLength, nil
+		}
+	}
+	return false, 0, bodyLength, nil
+}
+
+// DecryptBody decrypts and authenticates the input (optional entry metadata)
+// using the input secret. It returns ErrBodyAuthentication if the body or
+// its length were tampered with.
+func (h aes256GCMBucketEncryptor) DecryptBody(secret []byte, ciphertext []byte) ([]byte, error) {
+	aead, _, err := deriveAEADBodyKeys(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrBodyAuthentication
+	}
+
+	bodyLength := make([]byte, 4)
+	binary.BigEndian.PutUint32(bodyLength, uint32(len(ciphertext)))
+	body, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], bodyLength)
+	if err != nil {
+		return nil, ErrBodyAuthentication
+	}
+	return body, nil
+}
+
+// deriveAEADHeaderTag derives the header tag of an authenticated bucket
+// entry, covering the key check bytes and the flag byte
+func deriveAEADHeaderTag(secret []byte, flag MetadataType) ([]byte, error) {
+	r := hkdf.New(sha256.New, secret, DeriveAEADHeaderSalt, []byte{byte(flag)})
+	tag := make([]byte, CtxtKeyCheckSize+1)
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+// deriveAEADBodyKeys derives the body encryption AEAD and the nonce
+// derivation key of an authenticated bucket entry
+func deriveAEADBodyKeys(secret []byte) (cipher.AEAD, []byte, error) {
+	key, err := derivePad(secret, DeriveAEADBodyKeySalt, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonceKey, err := derivePad(secret, DeriveAEADNonceKeySalt, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nonceKey, nil
+}
+
 // xorBytes is a helper function that computes the XOR of two byte slices that
 // must be of the same length.
 func xorBytes(b1, b2 []byte) []byte {
@@ -144,6 +290,8 @@ func NewBucketEncryptor(id uint16) (BucketEncryptor, error) {
 	switch id {
 	case BucketEncryptorHKDFSHA256:
 		return NewHKDFSHA256BucketEncryptor(), nil
+	case BucketEncryptorAES256GCM:
+		return NewAES256GCMBucketEncryptor(), nil
 	default:
 		return nil, errors.New("unsupported bucket encryptor")
 	}
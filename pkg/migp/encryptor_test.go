@@ -6,19 +6,24 @@ package migp
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/hex"
 	"testing"
 
 	"github.com/cloudflare/circl/oprf"
 )
 
+// encryptDecryptTestCase is a bucket entry to encrypt under the OPRF output
+// for secret
+type encryptDecryptTestCase struct {
+	secret       []byte
+	metadataFlag MetadataType
+	metadata     []byte
+}
+
 // TestEncryptDecrypt tests that bucket entry can be encrypted and then
 // correctly decrypted
 func TestEncryptDecrypt(t *testing.T) {
-	testCases := []struct {
-		secret       []byte
-		metadataFlag MetadataType
-		metadata     []byte
-	}{
+	testCases := []encryptDecryptTestCase{
 		{[]byte("test"), MetadataDummy, []byte("helloworld")},
 		{[]byte("124jbZC"), MetadataSimilarPassword, nil},
 		{[]byte("1ujkbjkfdb09fjdzvzjkdfA!#"), 100, []byte("12")},
@@ -40,12 +45,23 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	bucketEncryptor, err := NewBucketEncryptor(DefaultBucketEncryptor)
-	if err != nil {
-		t.Fatal(err)
+	for _, id := range []uint16{BucketEncryptorHKDFSHA256, BucketEncryptorAES256GCM} {
+		bucketEncryptor, err := NewBucketEncryptor(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testEncryptDecrypt(t, bucketEncryptor, oprfServer, oprfClient, testCases)
 	}
+}
 
+// testEncryptDecrypt runs the encryption test cases for a single bucket
+// encryptor
+func testEncryptDecrypt(t *testing.T, bucketEncryptor BucketEncryptor, oprfServer *oprf.Server, oprfClient *oprf.Client, testCases []encryptDecryptTestCase) {
 	for _, test := range testCases {
+		if bucketEncryptor.ID() == BucketEncryptorAES256GCM && !test.metadataFlag.Valid() {
+			// authenticated headers only carry valid flags
+			continue
+		}
 
 		// Client generates blinded element
 		oprfRequest, err := oprfClient.Request([][]byte{test.secret})
@@ -90,8 +106,8 @@ func TestEncryptDecrypt(t *testing.T) {
 		if flag != test.metadataFlag {
 			t.Errorf("decryption got mdFlag of %d (expected %d)", flag, test.metadataFlag)
 		}
-		if len(test.metadata) != bodyLength {
-			t.Errorf("header decryption failed to recover length. got %d, expected %d", bodyLength, len(test.metadata))
+		if len(ciphertext)-HeaderSize != bodyLength {
+			t.Errorf("header decryption failed to recover length. got %d, expected %d", bodyLength, len(ciphertext)-HeaderSize)
 		}
 
 		// Client decrypts body
@@ -105,6 +121,136 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 }
 
+// TestBucketEncryptorVectors checks each bucket encryptor against test
+// vectors computed outside of Go by the following Python script, which
+// implements HKDF with the standard library and takes AES-GCM from the
+// cryptography package, and prints the vectors in order:
+//
+//	import hashlib, hmac, struct
+//	from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+//
+//	def hkdf(secret, salt, info, length):
+//	    prk = hmac.new(salt, secret, hashlib.sha256).digest()
+//	    okm, t = b"", b""
+//	    for i in range(1, (length + 31) // 32 + 1):
+//	        t = hmac.new(prk, t + info + bytes([i]), hashlib.sha256).digest()
+//	        okm += t
+//	    return okm[:length]
+//
+//	def xor(a, b):
+//	    return bytes(x ^ y for x, y in zip(a, b))
+//
+//	def hkdf_sha256_entry(secret, flag, body):
+//	    header = xor(bytes(20) + bytes([flag]), hkdf(secret, b"MIGP derive pad header", b"", 21))
+//	    return header + struct.pack(">I", len(body)) + xor(body, hkdf(secret, b"MIGP derive pad body", b"", len(body)))
+//
+//	def aes256gcm_entry(secret, flag, body):
+//	    tag = hkdf(secret, b"MIGP derive AEAD header", bytes([flag]), 21)
+//	    key = hkdf(secret, b"MIGP derive AEAD body key", b"", 32)
+//	    nonce_key = hkdf(secret, b"MIGP derive AEAD nonce key", b"", 32)
+//	    nonce = hmac.new(nonce_key, bytes([flag]) + body, hashlib.sha256).digest()[:12]
+//	    length = struct.pack(">I", 12 + len(body) + 16)
+//	    return tag + length + nonce + AESGCM(key).encrypt(nonce, body, length)
+//
+//	inputs = [
+//	    (b"test secret", 1, b"my favorite breach"),
+//	    (b"another secret", 2, b""),
+//	    (bytes(range(32)), 3, bytes.fromhex("0001026d65746164617461")),
+//	]
+//	for entry in (hkdf_sha256_entry, aes256gcm_entry):
+//	    for secret, flag, body in inputs:
+//	        print(entry(secret, flag, body).hex())
+func TestBucketEncryptorVectors(t *testing.T) {
+	testVectors := []struct {
+		id         uint16
+		secret     string
+		flag       MetadataType
+		body       string
+		ciphertext string
+	}{
+		{BucketEncryptorHKDFSHA256, "7465737420736563726574", MetadataBreachedPassword, "6d79206661766f7269746520627265616368",
+			"e49b574f6189598642a25d07216a7121432fdf14cc000000124fea94e5f808da86777836c11fca47ed737e"},
+		{BucketEncryptorHKDFSHA256, "616e6f7468657220736563726574", MetadataSimilarPassword, "",
+			"6269d36d5a5c420f840dd80962d623bf5c2a4ca37900000000"},
+		{BucketEncryptorHKDFSHA256, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", MetadataBreachedUsername, "0001026d65746164617461",
+			"426a766d0d4423175210719b5dd5260dfcbcfd27230000000bcda8e5c71aa2eb21efebb2"},
+		{BucketEncryptorAES256GCM, "7465737420736563726574", MetadataBreachedPassword, "6d79206661766f7269746520627265616368",
+			"111d20a5f13dd9c1a2d617a526e1a3e15aaceca99b0000002ed75e038f9f6e5917b54220417842212b52c9d4a04ce04f876fed32b063721e9d49cef76d3b50d998cadb37d7f3d0"},
+		{BucketEncryptorAES256GCM, "616e6f7468657220736563726574", MetadataSimilarPassword, "",
+			"ea610563a9d352736c9f0d58be5eada1f782657d580000001c4abf4505eecceae2e273b81eef00ff74a61bcd2a8c3d5d0544b8ee5e"},
+		{BucketEncryptorAES256GCM, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", MetadataBreachedUsername, "0001026d65746164617461",
+			"c1d125c783f93b951da17812286fb86dbeb35a042100000027b586a3b2818558279c48f7e06342261e49c7b4bdaf14ce08ce88aac90f75e4785d0d0b372fa196"},
+	}
+
+	for i, test := range testVectors {
+		bucketEncryptor, err := NewBucketEncryptor(test.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret, _ := hex.DecodeString(test.secret)
+		body, _ := hex.DecodeString(test.body)
+		expected, _ := hex.DecodeString(test.ciphertext)
+
+		ciphertext, err := bucketEncryptor.Encrypt(secret, test.flag, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ciphertext, expected) {
+			t.Errorf("vector %d: got %x, expected %x", i, ciphertext, expected)
+		}
+
+		valid, flag, bodyLength, err := bucketEncryptor.DecryptHeader(secret, expected)
+		if err != nil || !valid || flag != test.flag || bodyLength != len(expected)-HeaderSize {
+			t.Fatalf("vector %d: header decryption failed", i)
+		}
+		decrypted, err := bucketEncryptor.DecryptBody(secret, expected[HeaderSize:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, body) {
+			t.Errorf("vector %d: got body %x, expected %x", i, decrypted, body)
+		}
+	}
+}
+
+// TestAES256GCMTampering checks that the authenticated bucket encryptor
+// rejects tampered entries
+func TestAES256GCMTampering(t *testing.T) {
+	bucketEncryptor := NewAES256GCMBucketEncryptor()
+	secret := []byte("test secret")
+	ciphertext, err := bucketEncryptor.Encrypt(secret, MetadataBreachedPassword, []byte("my favorite breach"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flipping any header bit breaks the key check
+	for i := 0; i < CtxtKeyCheckSize+1; i++ {
+		tampered := append([]byte{}, ciphertext...)
+		tampered[i] ^= 0x01
+		if valid, _, _, err := bucketEncryptor.DecryptHeader(secret, tampered); err != nil || valid {
+			t.Errorf("header byte %d: tampering not detected", i)
+		}
+	}
+	if valid, _, _, err := bucketEncryptor.DecryptHeader([]byte("other secret"), ciphertext); err != nil || valid {
+		t.Error("header matched under the wrong secret")
+	}
+
+	// flipping any body bit, or truncating the body, fails authentication
+	body := ciphertext[HeaderSize:]
+	for i := range body {
+		tampered := append([]byte{}, body...)
+		tampered[i] ^= 0x01
+		if _, err := bucketEncryptor.DecryptBody(secret, tampered); err != ErrBodyAuthentication {
+			t.Errorf("body byte %d: got %v, expected %v", i, err, ErrBodyAuthentication)
+		}
+	}
+	for _, length := range []int{0, 27, len(body) - 1} {
+		if _, err := bucketEncryptor.DecryptBody(secret, body[:length]); err != ErrBodyAuthentication {
+			t.Errorf("body truncated to %d bytes: got %v, expected %v", length, err, ErrBodyAuthentication)
+		}
+	}
+}
+
 // BenchmarkHKDFSHA256Encryptor runs benchmark tests for the bucket encryptor
 func BenchmarkHKDFSHA256Encryptor(b *testing.B) {
 	secret := []byte{32}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.18
+// +build go1.18
+
+package migp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+)
+
+// FuzzClientRequest checks that any client request that decodes re-encodes
+// to the same bytes
+func FuzzClientRequest(f *testing.F) {
+	client, err := NewClient(DefaultConfig())
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, request := range []func([]byte, []byte) (ClientRequest, ClientRequestContext, error){client.Request, client.RequestCombined} {
+		r, _, err := request([]byte("username"), []byte("password"))
+		if err != nil {
+			f.Fatal(err)
+		}
+		data, err := r.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{ClientRequestEncodingV1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var r ClientRequest
+		if err := r.UnmarshalBinary(data); err != nil {
+			return
+		}
+		encoded, err := r.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, encoded) {
+			t.Fatalf("re-encoding mismatch: %x != %x", data, encoded)
+		}
+	})
+}
+
+// FuzzServerResponse checks that any server response that decodes re-encodes
+// to the same bytes, for every suite and mode
+func FuzzServerResponse(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 1}, uint8(0), false, uint8(1))
+	f.Add(make([]byte, 256), uint8(1), true, uint8(2))
+
+	f.Fuzz(func(t *testing.T, data []byte, suite uint8, verifiable bool, elements uint8) {
+		mode := oprf.BaseMode
+		if verifiable {
+			mode = oprf.VerifiableMode
+		}
+		r, err := ParseServerResponse(data, OPRFSuites[int(suite)%len(OPRFSuites)], mode, int(elements%MaxBlindElements)+1)
+		if err != nil {
+			return
+		}
+		encoded, err := r.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, encoded) {
+			t.Fatalf("re-encoding mismatch: %x != %x", data, encoded)
+		}
+	})
+}
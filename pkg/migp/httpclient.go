@@ -0,0 +1,311 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTPClient queries a MIGP server over HTTP. It is built once from a Config
+// and is safe for concurrent use, so it can be shared by a long-lived
+// service.
+type HTTPClient struct {
+	client      *Client
+	evaluateURL string
+	batchURL    string
+	oprfURL     string
+	bucketURL   string
+	httpClient  *http.Client
+	retries     int
+	backoff     time.Duration
+	header      http.Header
+
+	// binaryRequests sends requests to the evaluation endpoint in the binary
+	// encoding instead of JSON
+	binaryRequests bool
+}
+
+// HTTPClientOption configures an HTTPClient
+type HTTPClientOption func(*HTTPClient)
+
+// WithHTTPClient sets the HTTP client used to send requests, e.g. to set a
+// timeout or transport. The default is http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries retries requests that fail with a 5xx status or a transport
+// error up to retries times, waiting backoff before the first retry and
+// doubling the wait before each following one
+func WithRetries(retries int, backoff time.Duration) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithUserAgent sets the User-Agent header of requests
+func WithUserAgent(userAgent string) HTTPClientOption {
+	return WithHeader("User-Agent", userAgent)
+}
+
+// WithAuthorization sets the Authorization header of requests, e.g. to
+// "Bearer <token>"
+func WithAuthorization(authorization string) HTTPClientOption {
+	return WithHeader("Authorization", authorization)
+}
+
+// WithHeader sets a header on every request
+func WithHeader(key, value string) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.header.Set(key, value)
+	}
+}
+
+// WithBinaryRequests sends queries in the compact binary encoding of
+// ClientRequest instead of JSON. Batch queries are always sent as JSON.
+func WithBinaryRequests() HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.binaryRequests = true
+	}
+}
+
+// WithBucketURL fetches buckets from a static export of the server's buckets
+// at bucketURL, such as a CDN or object storage bucket, and only sends the
+// OPRF evaluation to the server's /oprf endpoint. Buckets are fetched from
+// <bucketURL>/<bucket key>, where the bucket key is as given by BucketKey.
+// Batch queries are always sent to the server.
+func WithBucketURL(bucketURL string) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.bucketURL = strings.TrimSuffix(bucketURL, "/")
+	}
+}
+
+// NewHTTPClient returns a client for the MIGP server at baseURL, which serves
+// queries at /evaluate, batch queries at /evaluate-batch and OPRF-only
+// evaluations at /oprf
+func NewHTTPClient(cfg Config, baseURL string, opts ...HTTPClientOption) (*HTTPClient, error) {
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := newHTTPClient(client)
+	c.evaluateURL = baseURL + "/evaluate"
+	c.batchURL = baseURL + "/evaluate-batch"
+	c.oprfURL = baseURL + "/oprf"
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.retries < 0 {
+		return nil, errors.New("negative number of retries")
+	}
+	return c, nil
+}
+
+// newHTTPClient returns an HTTPClient with default options wrapping client
+func newHTTPClient(client *Client) *HTTPClient {
+	return &HTTPClient{
+		client:     client,
+		httpClient: http.DefaultClient,
+		header:     make(http.Header),
+	}
+}
+
+// Query submits a MIGP query for a username and password
+func (c *HTTPClient) Query(ctx context.Context, username, password []byte) (BreachStatus, []byte, error) {
+	migpRequest, reqContext, err := c.client.Request(username, password)
+	if err != nil {
+		return NotInBreach, nil, err
+	}
+	response, err := c.evaluate(ctx, migpRequest, reqContext)
+	if err != nil {
+		return NotInBreach, nil, err
+	}
+	return reqContext.Finalize(response)
+}
+
+// QueryCombined submits a combined MIGP query for a username and password
+// and for the username alone
+func (c *HTTPClient) QueryCombined(ctx context.Context, username, password []byte) (CombinedResult, error) {
+	migpRequest, reqContext, err := c.client.RequestCombined(username, password)
+	if err != nil {
+		return CombinedResult{}, err
+	}
+	response, err := c.evaluate(ctx, migpRequest, reqContext)
+	if err != nil {
+		return CombinedResult{}, err
+	}
+	return reqContext.FinalizeCombined(response)
+}
+
+// QueryBatch submits queries for several credentials in a single HTTP
+// request, and returns a result for each credential in order. Failures of
+// individual queries are reported in their results; an error is only
+// returned if the batch as a whole failed.
+func (c *HTTPClient) QueryBatch(ctx context.Context, credentials []Credential) ([]BatchResult, error) {
+	results := make([]BatchResult, len(credentials))
+	batch := BatchRequest{Version: uint32(c.client.version)}
+	var reqContexts []ClientRequestContext
+	var pending []int
+	for i, credential := range credentials {
+		request, reqContext, err := c.client.Request(credential.Username, credential.Password)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		batch.Requests = append(batch.Requests, request)
+		reqContexts = append(reqContexts, reqContext)
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		return results, nil
+	}
+
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.do(ctx, http.MethodPost, c.batchURL, ContentTypeJSON, payload)
+	if err != nil {
+		return nil, err
+	}
+	var response BatchResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	if uint16(response.Version) != c.client.version {
+		return nil, fmt.Errorf("%w: wrong version in reply", ErrVersionMismatch)
+	}
+	if len(response.Items) != len(pending) {
+		return nil, fmt.Errorf("wrong number of items in reply: want %d, got %d", len(pending), len(response.Items))
+	}
+
+	for j, item := range response.Items {
+		result := &results[pending[j]]
+		if item.Error != "" {
+			result.Err = errors.New(item.Error)
+			continue
+		}
+		serverResponse, err := reqContexts[j].ParseResponse(item.Response)
+		if err != nil {
+			result.Err = err
+			continue
+		}
+		result.Status, result.Metadata, result.Err = reqContexts[j].Finalize(serverResponse)
+	}
+	return results, nil
+}
+
+// evaluate posts a MIGP request to the evaluation endpoint and parses the
+// response. With a bucket URL set, the request is posted to the OPRF-only
+// endpoint and the bucket is fetched from the bucket URL.
+func (c *HTTPClient) evaluate(ctx context.Context, migpRequest ClientRequest, reqContext ClientRequestContext) (ServerResponse, error) {
+	var payload []byte
+	var err error
+	contentType := ContentTypeJSON
+	if c.binaryRequests {
+		contentType = ContentTypeBinary
+		payload, err = migpRequest.MarshalBinary()
+	} else {
+		payload, err = json.Marshal(migpRequest)
+	}
+	if err != nil {
+		return ServerResponse{}, err
+	}
+	targetURL := c.evaluateURL
+	if c.bucketURL != "" {
+		targetURL = c.oprfURL
+	}
+	body, err := c.do(ctx, http.MethodPost, targetURL, contentType, payload)
+	if err != nil {
+		return ServerResponse{}, err
+	}
+	response, err := reqContext.ParseResponse(body)
+	if err != nil || c.bucketURL == "" {
+		return response, err
+	}
+	response.BucketContents, err = c.fetchBucket(ctx, migpRequest.Epoch, migpRequest.BucketID)
+	return response, err
+}
+
+// fetchBucket fetches the contents of a bucket from the bucket URL, where
+// missing buckets are empty
+func (c *HTTPClient) fetchBucket(ctx context.Context, epoch uint32, bucketIDHex string) ([]byte, error) {
+	contents, err := c.do(ctx, http.MethodGet, c.bucketURL+"/"+BucketKey(epoch, bucketIDHex), "", nil)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.code == http.StatusNotFound {
+		return nil, nil
+	}
+	return contents, err
+}
+
+// statusError is returned for HTTP responses with a status other than 200 OK
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Request failed with status code %d", e.code)
+}
+
+// do makes an HTTP request with the given payload, if any, and returns the
+// response body, retrying on 5xx statuses and transport errors
+func (c *HTTPClient) do(ctx context.Context, method, targetURL, contentType string, payload []byte) ([]byte, error) {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		body, retry, err := c.doOnce(ctx, method, targetURL, contentType, payload)
+		if err == nil || !retry || attempt >= c.retries {
+			return body, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// doOnce makes a single HTTP request, and reports whether a failed request
+// may be retried
+func (c *HTTPClient) doOnce(ctx context.Context, method, targetURL, contentType string, payload []byte) ([]byte, bool, error) {
+	var requestBody io.Reader
+	if payload != nil {
+		requestBody = bytes.NewReader(payload)
+	}
+	request, err := http.NewRequest(method, targetURL, requestBody)
+	if err != nil {
+		return nil, false, err
+	}
+	request = request.WithContext(ctx)
+	for key, values := range c.header {
+		request.Header[key] = values
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		// the context's error is final, anything else is transient
+		return nil, ctx.Err() == nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, response.StatusCode >= 500, &statusError{code: response.StatusCode}
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	return body, ctx.Err() == nil, err
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testHTTPServer serves MIGP queries for a single breached credential, and
+// fails the first failures requests with a 503 status
+func testHTTPServer(t *testing.T, failures int32) (*httptest.Server, *int32) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: make(map[string][]byte)}
+	username := []byte("test@mail.com")
+	newEntry, err := server.EncryptBucketEntry(username, []byte("password1234"), MetadataBreachedPassword, []byte("breach"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.store[server.BucketKey(username)] = newEntry
+
+	var requests int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if req.Header.Get("User-Agent") != "migp-test" || req.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		var request ClientRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		response, err := server.HandleRequest(request, kv)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		data, err := response.MarshalBinary()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	}))
+	return httpServer, &requests
+}
+
+// TestHTTPClient queries a server that fails transiently, and checks that
+// requests are retried and carry the configured headers
+func TestHTTPClient(t *testing.T) {
+	httpServer, requests := testHTTPServer(t, 2)
+	defer httpServer.Close()
+
+	client, err := NewHTTPClient(DefaultConfig(), httpServer.URL,
+		WithHTTPClient(&http.Client{Timeout: 10 * time.Second}),
+		WithRetries(2, time.Millisecond),
+		WithUserAgent("migp-test"),
+		WithAuthorization("Bearer token"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, metadata, err := client.Query(context.Background(), []byte("test@mail.com"), []byte("password1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != InBreach || string(metadata) != "breach" {
+		t.Fatalf("want %s %q, got %s %q", InBreach, "breach", status, metadata)
+	}
+	if got := atomic.LoadInt32(requests); got != 3 {
+		t.Fatalf("want 3 requests, got %d", got)
+	}
+
+	// the client is reused for further queries
+	status, _, err = client.Query(context.Background(), []byte("test@mail.com"), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != NotInBreach {
+		t.Fatalf("want %s, got %s", NotInBreach, status)
+	}
+}
+
+// TestHTTPClientErrors checks that retries are bounded, that 4xx statuses are
+// not retried, and that cancellation stops retrying
+func TestHTTPClientErrors(t *testing.T) {
+	httpServer, requests := testHTTPServer(t, 3)
+	defer httpServer.Close()
+
+	client, err := NewHTTPClient(DefaultConfig(), httpServer.URL, WithRetries(1, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.Query(context.Background(), []byte("test@mail.com"), []byte("password1234")); err == nil {
+		t.Fatal("expected error after exhausting retries")
+	}
+	if got := atomic.LoadInt32(requests); got != 2 {
+		t.Fatalf("want 2 requests, got %d", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := client.Query(ctx, []byte("test@mail.com"), []byte("password1234")); err == nil {
+		t.Fatal("expected error for canceled context")
+	}
+
+	// without credentials the server answers 401, which is not retried
+	atomic.StoreInt32(requests, 3)
+	if _, _, err := client.Query(context.Background(), []byte("test@mail.com"), []byte("password1234")); err == nil {
+		t.Fatal("expected error for unauthorized request")
+	}
+	if got := atomic.LoadInt32(requests); got != 4 {
+		t.Fatalf("want 1 more request, got %d", got-3)
+	}
+
+	if _, err := NewHTTPClient(DefaultConfig(), httpServer.URL, WithRetries(-1, 0)); err == nil {
+		t.Fatal("expected error for negative retries")
+	}
+}
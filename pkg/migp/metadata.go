@@ -0,0 +1,258 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// MetadataVersion1 is the first version of the structured metadata
+	// encoding
+	MetadataVersion1 = 0x01
+)
+
+// Structured metadata field tags
+const (
+	metadataTagBreachName = 0x01
+	metadataTagBreachDate = 0x02
+	metadataTagSource     = 0x03
+	metadataTagHashType   = 0x04
+	metadataTagFirstSeen  = 0x05
+)
+
+var (
+	// metadataMagic prefixes structured metadata, telling it apart from
+	// legacy raw metadata, which is expected to be text
+	metadataMagic = []byte{0x00, 'M', 'D'}
+
+	// ErrMalformedMetadata is returned when structured metadata cannot be
+	// decoded
+	ErrMalformedMetadata = errors.New("malformed structured metadata")
+)
+
+// metadataDateLayout is the layout of dates without a time of day
+const metadataDateLayout = "2006-01-02"
+
+// Metadata is structured information about the breach a bucket entry comes
+// from. Metadata stored before the structured encoding was introduced, or
+// stored raw, is decoded into Raw.
+type Metadata struct {
+	BreachName string
+	BreachDate time.Time
+	Source     string
+	HashType   string
+	FirstSeen  time.Time
+
+	// Raw holds legacy metadata, which is an opaque byte string
+	Raw []byte
+}
+
+// MarshalBinary encodes the metadata in the following binary format:
+// <magic>|<8-bit version>|<fields>
+// where each field is <8-bit tag>|<uvarint length>|<value>, strings are
+// UTF-8 and times are varint Unix seconds. Zero fields are omitted. Legacy
+// metadata is returned raw.
+func (m *Metadata) MarshalBinary() ([]byte, error) {
+	if m.Raw != nil {
+		return append([]byte{}, m.Raw...), nil
+	}
+	buffer := bytes.NewBuffer(append([]byte{}, metadataMagic...))
+	buffer.WriteByte(MetadataVersion1)
+	writeField := func(tag byte, value []byte) {
+		if len(value) == 0 {
+			return
+		}
+		buffer.WriteByte(tag)
+		length := make([]byte, binary.MaxVarintLen64)
+		buffer.Write(length[:binary.PutUvarint(length, uint64(len(value)))])
+		buffer.Write(value)
+	}
+	writeTime := func(tag byte, t time.Time) {
+		if t.IsZero() {
+			return
+		}
+		value := make([]byte, binary.MaxVarintLen64)
+		writeField(tag, value[:binary.PutVarint(value, t.Unix())])
+	}
+	writeField(metadataTagBreachName, []byte(m.BreachName))
+	writeTime(metadataTagBreachDate, m.BreachDate)
+	writeField(metadataTagSource, []byte(m.Source))
+	writeField(metadataTagHashType, []byte(m.HashType))
+	writeTime(metadataTagFirstSeen, m.FirstSeen)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary decodes structured metadata encoded with MarshalBinary.
+// Fields with unknown tags are skipped. It returns ErrMalformedMetadata if
+// data is not structured metadata; use ParseMetadata to fall back to legacy
+// metadata.
+func (m *Metadata) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, metadataMagic) || len(data) < len(metadataMagic)+1 {
+		return ErrMalformedMetadata
+	}
+	if data[len(metadataMagic)] != MetadataVersion1 {
+		return fmt.Errorf("unsupported metadata version: %d", data[len(metadataMagic)])
+	}
+
+	var decoded Metadata
+	data = data[len(metadataMagic)+1:]
+	for len(data) > 0 {
+		tag := data[0]
+		length, n := binary.Uvarint(data[1:])
+		if n <= 0 || length > uint64(len(data)-1-n) {
+			return ErrMalformedMetadata
+		}
+		value := data[1+n : 1+n+int(length)]
+		data = data[1+n+int(length):]
+
+		switch tag {
+		case metadataTagBreachName:
+			decoded.BreachName = string(value)
+		case metadataTagSource:
+			decoded.Source = string(value)
+		case metadataTagHashType:
+			decoded.HashType = string(value)
+		case metadataTagBreachDate, metadataTagFirstSeen:
+			seconds, n := binary.Varint(value)
+			if n <= 0 || n != len(value) {
+				return ErrMalformedMetadata
+			}
+			t := time.Unix(seconds, 0).UTC()
+			if tag == metadataTagBreachDate {
+				decoded.BreachDate = t
+			} else {
+				decoded.FirstSeen = t
+			}
+		}
+	}
+	*m = decoded
+	return nil
+}
+
+// ParseMetadata decodes bucket entry metadata, returning legacy metadata in
+// Raw if data is not structured metadata. Empty data yields nil.
+func ParseMetadata(data []byte) *Metadata {
+	if len(data) == 0 {
+		return nil
+	}
+	m := new(Metadata)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return &Metadata{Raw: append([]byte{}, data...)}
+	}
+	return m
+}
+
+// IsLegacy reports whether the metadata is legacy raw metadata
+func (m *Metadata) IsLegacy() bool {
+	return m.Raw != nil
+}
+
+// String returns a human-readable representation of the metadata
+func (m *Metadata) String() string {
+	if m.Raw != nil {
+		return string(m.Raw)
+	}
+	var fields []string
+	if m.BreachName != "" {
+		fields = append(fields, "breach: "+m.BreachName)
+	}
+	if !m.BreachDate.IsZero() {
+		fields = append(fields, "date: "+formatMetadataTime(m.BreachDate))
+	}
+	if m.Source != "" {
+		fields = append(fields, "source: "+m.Source)
+	}
+	if m.HashType != "" {
+		fields = append(fields, "hash: "+m.HashType)
+	}
+	if !m.FirstSeen.IsZero() {
+		fields = append(fields, "first seen: "+formatMetadataTime(m.FirstSeen))
+	}
+	return strings.Join(fields, ", ")
+}
+
+// metadataJSON is used for custom JSON (un)marshaling of Metadata
+type metadataJSON struct {
+	BreachName string `json:"breachName,omitempty"`
+	BreachDate string `json:"breachDate,omitempty"`
+	Source     string `json:"source,omitempty"`
+	HashType   string `json:"hashType,omitempty"`
+	FirstSeen  string `json:"firstSeen,omitempty"`
+	Raw        []byte `json:"raw,omitempty"`
+}
+
+// MarshalJSON serializes metadata to JSON, with times as dates if they have
+// no time of day and as RFC 3339 timestamps otherwise
+func (m *Metadata) MarshalJSON() ([]byte, error) {
+	aux := metadataJSON{
+		BreachName: m.BreachName,
+		Source:     m.Source,
+		HashType:   m.HashType,
+		Raw:        m.Raw,
+	}
+	if !m.BreachDate.IsZero() {
+		aux.BreachDate = formatMetadataTime(m.BreachDate)
+	}
+	if !m.FirstSeen.IsZero() {
+		aux.FirstSeen = formatMetadataTime(m.FirstSeen)
+	}
+	return json.Marshal(&aux)
+}
+
+// UnmarshalJSON deserializes metadata from JSON, accepting times as dates or
+// RFC 3339 timestamps
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	var aux metadataJSON
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	decoded := Metadata{
+		BreachName: aux.BreachName,
+		Source:     aux.Source,
+		HashType:   aux.HashType,
+		Raw:        aux.Raw,
+	}
+	var err error
+	if decoded.BreachDate, err = parseMetadataTime(aux.BreachDate); err != nil {
+		return err
+	}
+	if decoded.FirstSeen, err = parseMetadataTime(aux.FirstSeen); err != nil {
+		return err
+	}
+	*m = decoded
+	return nil
+}
+
+// formatMetadataTime formats t as a date if it has no time of day, and as an
+// RFC 3339 timestamp otherwise
+func formatMetadataTime(t time.Time) string {
+	t = t.UTC()
+	if t.Equal(t.Truncate(24 * time.Hour)) {
+		return t.Format(metadataDateLayout)
+	}
+	return t.Format(time.RFC3339)
+}
+
+// parseMetadataTime parses a date or an RFC 3339 timestamp, returning the
+// zero time for an empty string
+func parseMetadataTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(metadataDateLayout, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC().Truncate(time.Second), nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetadataSerialization(t *testing.T) {
+	tests := []Metadata{
+		{},
+		{BreachName: "Example"},
+		{
+			BreachName: "Example",
+			BreachDate: time.Date(2019, 1, 16, 0, 0, 0, 0, time.UTC),
+			Source:     "paste site",
+			HashType:   "bcrypt",
+			FirstSeen:  time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC),
+		},
+		{BreachDate: time.Date(1969, 7, 20, 0, 0, 0, 0, time.UTC)},
+	}
+	for i, test := range tests {
+		data, err := test.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Metadata
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("failed test %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(test, got) {
+			t.Errorf("failed test %d: want %+v, got %+v", i, test, got)
+		}
+		if parsed := ParseMetadata(data); !reflect.DeepEqual(&test, parsed) {
+			t.Errorf("failed test %d: want %+v, got %+v", i, test, parsed)
+		}
+	}
+}
+
+func TestMetadataUnknownField(t *testing.T) {
+	m := Metadata{BreachName: "Example", Source: "dump"}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fields added by later encoders are skipped
+	data = append(data, 0x7f, 3, 'a', 'b', 'c')
+	var got Metadata
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, got) {
+		t.Errorf("want %+v, got %+v", m, got)
+	}
+}
+
+func TestMetadataMalformed(t *testing.T) {
+	tests := [][]byte{
+		nil,
+		[]byte("legacy metadata"),
+		{0x00, 'M', 'D'},
+		{0x00, 'M', 'D', MetadataVersion1, metadataTagBreachName, 5, 'a'},
+		{0x00, 'M', 'D', MetadataVersion1, metadataTagBreachDate, 0},
+		{0x00, 'M', 'D', 0x02},
+	}
+	for i, data := range tests {
+		var m Metadata
+		if err := m.UnmarshalBinary(data); err == nil {
+			t.Errorf("failed test %d: expected error", i)
+		}
+	}
+}
+
+func TestParseLegacyMetadata(t *testing.T) {
+	if m := ParseMetadata(nil); m != nil {
+		t.Fatalf("want nil, got %+v", m)
+	}
+	legacy := []byte("breach 2019")
+	m := ParseMetadata(legacy)
+	if !m.IsLegacy() || !bytes.Equal(m.Raw, legacy) || m.String() != "breach 2019" {
+		t.Fatalf("want legacy %q, got %+v", legacy, m)
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, legacy) {
+		t.Fatalf("want %q, got %q", legacy, data)
+	}
+}
+
+func TestMetadataJSON(t *testing.T) {
+	var m Metadata
+	input := `{"breachName":"Example","breachDate":"2019-01-16","hashType":"md5","firstSeen":"2021-06-01T14:30:00+02:00"}`
+	if err := json.Unmarshal([]byte(input), &m); err != nil {
+		t.Fatal(err)
+	}
+	want := Metadata{
+		BreachName: "Example",
+		BreachDate: time.Date(2019, 1, 16, 0, 0, 0, 0, time.UTC),
+		HashType:   "md5",
+		FirstSeen:  time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(want, m) {
+		t.Fatalf("want %+v, got %+v", want, m)
+	}
+
+	data, err := json.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON := `{"breachName":"Example","breachDate":"2019-01-16","hashType":"md5","firstSeen":"2021-06-01T12:30:00Z"}`
+	if string(data) != wantJSON {
+		t.Fatalf("want %s, got %s", wantJSON, data)
+	}
+
+	if err := json.Unmarshal([]byte(`{"breachDate":"yesterday"}`), &m); err == nil {
+		t.Fatal("expected error parsing invalid date")
+	}
+}
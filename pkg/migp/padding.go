@@ -0,0 +1,218 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Bucket padding policies
+const (
+	// PaddingNone serves buckets as stored
+	PaddingNone = ""
+	// PaddingFixed pads buckets to exactly PaddingConfig.Entries entries,
+	// and refuses to serve larger buckets
+	PaddingFixed = "fixed"
+	// PaddingPowerOfTwo pads buckets to the next power of two entries, and
+	// to at least PaddingConfig.Entries entries
+	PaddingPowerOfTwo = "pow2"
+)
+
+// MaxPaddedEntries bounds the number of entries a bucket is padded to, so
+// that a misconfigured policy cannot make the server generate unbounded
+// responses
+const MaxPaddedEntries = 1 << 16
+
+var (
+	DerivePaddingKeySalt = []byte("MIGP derive padding key")
+
+	// ErrBucketTooLarge is returned when padding a bucket that holds more
+	// entries than the fixed padding size, as serving it would reveal its
+	// size
+	ErrBucketTooLarge = errors.New("bucket larger than the fixed padding size")
+)
+
+// PaddingConfig holds the policy for padding buckets with dummy entries when
+// they are served, so that bucket sizes don't reveal how many breached
+// credentials share a bucket. Dummy entries are encrypted with the bucket
+// encryptor under secrets no client can derive. Served buckets are shuffled
+// whatever the policy, so that entry order doesn't reveal insertion order.
+// Both are derived deterministically from the server's private key and the
+// bucket, so repeated queries for a bucket get identical responses.
+type PaddingConfig struct {
+	Policy  string `json:"policy,omitempty"`
+	Entries int    `json:"entries,omitempty"`
+
+	// DummyMetadataLength is the metadata length of dummy entries in otherwise
+	// empty buckets. In non-empty buckets, each dummy entry copies the body
+	// length of a stored entry.
+	DummyMetadataLength int `json:"dummyMetadataLength,omitempty"`
+}
+
+// validate returns an error if the padding policy is not supported
+func (c PaddingConfig) validate() error {
+	switch c.Policy {
+	case PaddingNone:
+		return nil
+	case PaddingFixed:
+		if c.Entries < 1 {
+			return errors.New("fixed bucket padding requires a positive number of entries")
+		}
+	case PaddingPowerOfTwo:
+	default:
+		return fmt.Errorf("unsupported bucket padding policy: %q", c.Policy)
+	}
+	if c.Entries < 0 || c.Entries > MaxPaddedEntries {
+		return fmt.Errorf("bucket padding entries %d out of bounds [0, %d]", c.Entries, MaxPaddedEntries)
+	}
+	if c.DummyMetadataLength < 0 {
+		return errors.New("negative dummy metadata length")
+	}
+	return nil
+}
+
+// paddedEntries returns the number of entries a bucket of n entries is
+// padded to, or ErrBucketTooLarge if it exceeds the fixed padding size
+func (c PaddingConfig) paddedEntries(n int) (int, error) {
+	padded := n
+	switch c.Policy {
+	case PaddingFixed:
+		if n > c.Entries {
+			return 0, fmt.Errorf("%w: %d entries, padding to %d", ErrBucketTooLarge, n, c.Entries)
+		}
+		padded = c.Entries
+	case PaddingPowerOfTwo:
+		padded = 1
+		for padded < n || padded < c.Entries {
+			padded <<= 1
+		}
+	}
+	if padded > MaxPaddedEntries {
+		padded = MaxPaddedEntries
+		if n > padded {
+			padded = n
+		}
+	}
+	return padded, nil
+}
+
+// CheckEntries returns ErrBucketTooLarge if a bucket of n entries can't be
+// served under the policy, so that oversized buckets can be caught when they
+// are written rather than when they are queried
+func (c PaddingConfig) CheckEntries(n int) error {
+	_, err := c.paddedEntries(n)
+	return err
+}
+
+// SplitBucketEntries splits bucket contents into its entries, relying only
+// on the plaintext body length in each entry header
+func SplitBucketEntries(contents []byte) ([][]byte, error) {
+	var entries [][]byte
+	for offset := 0; offset < len(contents); {
+		if offset+HeaderSize > len(contents) {
+			return nil, errors.New("parsing error in bucket")
+		}
+		bodyLength := int(binary.BigEndian.Uint32(contents[offset+CtxtKeyCheckSize+1 : offset+HeaderSize]))
+		if bodyLength > len(contents)-offset-HeaderSize {
+			return nil, errors.New("parsing error in bucket")
+		}
+		entries = append(entries, contents[offset:offset+HeaderSize+bodyLength])
+		offset += HeaderSize + bodyLength
+	}
+	return entries, nil
+}
+
+// paddingStream returns a pseudorandom stream for padding the bucket at key
+// bucketKey, with label separating its uses
+func paddingStream(paddingKey []byte, bucketKey, label string) cipher.Stream {
+	mac := hmac.New(sha256.New, paddingKey)
+	mac.Write([]byte(label))
+	mac.Write([]byte(bucketKey))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		// The key is always 32 bytes long.
+		panic(err)
+	}
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize))
+}
+
+// uniform returns a uniformly distributed integer in [0, n) read from stream
+func uniform(stream cipher.Stream, n int) int {
+	buf := make([]byte, 8)
+	limit := ^uint64(0) - ^uint64(0)%uint64(n)
+	for {
+		for i := range buf {
+			buf[i] = 0
+		}
+		stream.XORKeyStream(buf, buf)
+		if v := binary.BigEndian.Uint64(buf); v < limit {
+			return int(v % uint64(n))
+		}
+	}
+}
+
+// PadBucket pads the bucket contents stored at bucketKey with dummy entries
+// according to the server's padding policy, and shuffles the entries whatever
+// the policy, as HandleRequest does before serving a bucket
+func (s *Server) PadBucket(bucketKey string, contents []byte) ([]byte, error) {
+	entries, err := SplitBucketEntries(contents)
+	if err != nil {
+		return nil, err
+	}
+	stored := len(entries)
+	paddedEntries, err := s.padding.paddedEntries(stored)
+	if err != nil {
+		return nil, fmt.Errorf("bucket %s: %w", bucketKey, err)
+	}
+
+	// The body length of an encrypted entry is the metadata length plus a
+	// constant overhead that depends on the bucket encryptor.
+	overhead := 0
+	if paddedEntries > stored {
+		empty, err := s.bucketEncryptor.Encrypt(make([]byte, 32), MetadataDummy, nil)
+		if err != nil {
+			return nil, err
+		}
+		overhead = len(empty) - HeaderSize
+	}
+
+	lengths := paddingStream(s.paddingKey, bucketKey, "lengths")
+	index := make([]byte, 4)
+	for i := stored; i < paddedEntries; i++ {
+		metadataLength := s.padding.DummyMetadataLength
+		if stored > 0 {
+			metadataLength = len(entries[uniform(lengths, stored)]) - HeaderSize - overhead
+			if metadataLength < 0 {
+				metadataLength = 0
+			}
+		}
+		binary.BigEndian.PutUint32(index, uint32(i))
+		mac := hmac.New(sha256.New, s.paddingKey)
+		mac.Write(index)
+		mac.Write([]byte(bucketKey))
+		dummy, err := s.bucketEncryptor.Encrypt(mac.Sum(nil), MetadataDummy, make([]byte, metadataLength))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dummy)
+	}
+
+	shuffle := paddingStream(s.paddingKey, bucketKey, "shuffle")
+	for i := len(entries) - 1; i > 0; i-- {
+		j := uniform(shuffle, i+1)
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	padded := make([]byte, 0, len(contents)+(len(entries)-stored)*(HeaderSize+overhead))
+	for _, entry := range entries {
+		padded = append(padded, entry...)
+	}
+	return padded, nil
+}
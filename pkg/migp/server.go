@@ -7,9 +7,10 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 
 	"github.com/cloudflare/circl/oprf"
 )
@@ -26,21 +27,37 @@ type Server struct {
 	bucketEncryptor BucketEncryptor
 	slowHasher      SlowHasher
 	oprfServer      *oprf.Server
+	previousServer  *oprf.Server
 	oprfSuite       oprf.SuiteID
+	oprfMode        oprf.Mode
+	publicInput     uint8
+	epoch           uint32
 	privateKey      *oprf.PrivateKey
+	previousKey     *oprf.PrivateKey
+	padding         PaddingConfig
+	paddingKey      []byte
 }
 
 // ServerConfig stores all version information associated with a given server.
 // ServerConfig implements the json.Marshal and json.Unmarshal interfaces.
+//
+// PrivateKey is the OPRF key for the current key epoch, Config.Epoch. During
+// a key rotation, PreviousPrivateKey holds the key for the epoch before it,
+// and the server answers queries for both epochs. Padding sets how buckets
+// are padded when served.
 type ServerConfig struct {
 	Config
-	PrivateKey *oprf.PrivateKey
+	PrivateKey         *oprf.PrivateKey
+	PreviousPrivateKey *oprf.PrivateKey
+	Padding            PaddingConfig
 }
 
 // auxServerConfig is used for custom JSON (un)marshaling of ServerConfig
 type auxServerConfig struct {
 	Config
-	PrivateKey []byte `json:"privateKey"`
+	PrivateKey         []byte        `json:"privateKey"`
+	PreviousPrivateKey []byte        `json:"previousPrivateKey,omitempty"`
+	Padding            PaddingConfig `json:"padding"`
 }
 
 // MarshalJSON serializes a server configuration to JSON
@@ -49,9 +66,17 @@ func (c *ServerConfig) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		panic(err)
 	}
+	var serializedPreviousKey []byte
+	if c.PreviousPrivateKey != nil {
+		if serializedPreviousKey, err = c.PreviousPrivateKey.Serialize(); err != nil {
+			panic(err)
+		}
+	}
 	return json.Marshal(&auxServerConfig{
-		Config:     c.Config,
-		PrivateKey: serializedPrivateKey,
+		Config:             c.Config,
+		PrivateKey:         serializedPrivateKey,
+		PreviousPrivateKey: serializedPreviousKey,
+		Padding:            c.Padding,
 	})
 }
 
@@ -62,42 +87,114 @@ func (c *ServerConfig) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	c.Config = aux.Config
+	c.Padding = aux.Padding
 	c.PrivateKey = new(oprf.PrivateKey)
 	if err := c.PrivateKey.Deserialize(aux.OPRFSuite, aux.PrivateKey); err != nil {
 		return err
 	}
+	c.PreviousPrivateKey = nil
+	if len(aux.PreviousPrivateKey) > 0 {
+		c.PreviousPrivateKey = new(oprf.PrivateKey)
+		if err := c.PreviousPrivateKey.Deserialize(aux.OPRFSuite, aux.PreviousPrivateKey); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // Config returns an inspectable ServerConfig associated
-// with the given server.
+// with the given server. In verifiable mode, the embedded Config carries the
+// server's public key for the current epoch and is safe to publish to clients.
 func (s *Server) Config() *ServerConfig {
+	cfg, err := s.EpochConfig(s.epoch)
+	if err != nil {
+		// The current epoch always has a key.
+		panic(err)
+	}
 	return &ServerConfig{
-		Config: Config{
-			Version:           s.version,
-			BucketIDBitSize:   s.bucketIDBitSize,
-			BucketHasherID:    s.bucketHasher.ID(),
-			SlowHasherID:      s.slowHasher.ID(),
-			BucketEncryptorID: s.bucketEncryptor.ID(),
-			OPRFSuite:         s.oprfSuite,
-		},
-		PrivateKey: s.privateKey,
+		Config:             cfg,
+		PrivateKey:         s.privateKey,
+		PreviousPrivateKey: s.previousKey,
+		Padding:            s.padding,
+	}
+}
+
+// EpochConfig returns the client configuration for the given key epoch,
+// which must be the current epoch or, during a key rotation, the previous
+// one.
+func (s *Server) EpochConfig(epoch uint32) (Config, error) {
+	oprfServer, err := s.oprfServerForEpoch(epoch)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg := Config{
+		Version:           s.version,
+		BucketIDBitSize:   s.bucketIDBitSize,
+		BucketHasherID:    s.bucketHasher.ID(),
+		SlowHasherID:      s.slowHasher.ID(),
+		SlowHashParams:    s.slowHasher.Params(),
+		BucketEncryptorID: s.bucketEncryptor.ID(),
+		OPRFSuite:         s.oprfSuite,
+		OPRFMode:          s.oprfMode,
+		PublicInput:       s.publicInput,
+		Epoch:             epoch,
+	}
+	if s.oprfMode == oprf.VerifiableMode {
+		if cfg.PublicKey, err = oprfServer.GetPublicKey().Serialize(); err != nil {
+			return Config{}, err
+		}
 	}
+	return cfg, nil
+}
+
+// Epoch returns the server's current key epoch
+func (s *Server) Epoch() uint32 {
+	return s.epoch
+}
+
+// Epochs returns the key epochs the server holds keys for: the current epoch
+// and, during a key rotation, the previous one
+func (s *Server) Epochs() []uint32 {
+	if s.previousServer == nil {
+		return []uint32{s.epoch}
+	}
+	return []uint32{s.epoch, s.epoch - 1}
+}
+
+// oprfServerForEpoch returns the OPRF server holding the key for epoch
+func (s *Server) oprfServerForEpoch(epoch uint32) (*oprf.Server, error) {
+	if epoch == s.epoch {
+		return s.oprfServer, nil
+	}
+	if s.previousServer != nil && epoch == s.epoch-1 {
+		return s.previousServer, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownEpoch, epoch)
 }
 
 // DefaultServerConfig generates a new default server state with a freshly keyed OPRF instance.
 func DefaultServerConfig() ServerConfig {
-	privateKey, err := oprf.GenerateKey(DefaultOPRFSuite, rand.Reader)
+	cfg, err := NewServerConfig(DefaultConfig())
 	if err != nil {
 		// This will only occur in the event of developer error as we
 		// supply working defaults.
 		panic(err)
 	}
+	return cfg
+}
 
+// NewServerConfig generates a new server state for the given configuration
+// with a freshly generated private key for its OPRF suite.
+func NewServerConfig(cfg Config) (ServerConfig, error) {
+	privateKey, err := oprf.GenerateKey(cfg.OPRFSuite, rand.Reader)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	cfg.PublicKey = nil
 	return ServerConfig{
-		Config:     DefaultConfig(),
+		Config:     cfg,
 		PrivateKey: privateKey,
-	}
+	}, nil
 }
 
 // NewServer initializes and returns a new MIGP server from the given
@@ -114,7 +211,7 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 		return nil, err
 	}
 
-	s.slowHasher, err = NewSlowHasher(cfg.SlowHasherID)
+	s.slowHasher, err = NewSlowHasher(cfg.SlowHasherID, cfg.SlowHashParams)
 	if err != nil {
 		return nil, err
 	}
@@ -124,36 +221,133 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 		return nil, err
 	}
 
+	if err := validatePublicInput(cfg.PublicInput); err != nil {
+		return nil, err
+	}
+	s.publicInput = cfg.PublicInput
+	s.epoch = cfg.Epoch
+
+	if err := checkPrivateKey(cfg.OPRFSuite, cfg.PrivateKey); err != nil {
+		return nil, err
+	}
 	s.oprfSuite = cfg.OPRFSuite
+	s.oprfMode = cfg.OPRFMode
 	s.privateKey = cfg.PrivateKey
 
-	s.oprfServer, err = oprf.NewServer(s.oprfSuite, s.privateKey)
+	s.oprfServer, err = newOPRFServer(s.oprfSuite, s.oprfMode, s.privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Padding.validate(); err != nil {
+		return nil, err
+	}
+	s.padding = cfg.Padding
+	serializedKey, err := s.privateKey.Serialize()
 	if err != nil {
 		return nil, err
 	}
+	if s.paddingKey, err = derivePad(serializedKey, DerivePaddingKeySalt, 32); err != nil {
+		return nil, err
+	}
+
+	if cfg.PreviousPrivateKey != nil {
+		if s.epoch == 0 {
+			return nil, errors.New("previous private key requires an epoch greater than zero")
+		}
+		if err := checkPrivateKey(s.oprfSuite, cfg.PreviousPrivateKey); err != nil {
+			return nil, err
+		}
+		s.previousKey = cfg.PreviousPrivateKey
+		s.previousServer, err = newOPRFServer(s.oprfSuite, s.oprfMode, s.previousKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A configured public key must match the private key, since clients
+	// verify evaluations against it.
+	if s.oprfMode == oprf.VerifiableMode && cfg.PublicKey != nil {
+		publicKey, err := s.oprfServer.GetPublicKey().Serialize()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(publicKey, cfg.PublicKey) {
+			return nil, errors.New("public key doesn't match private key")
+		}
+	}
 	return s, nil
 }
 
+// checkPrivateKey returns an error if key is not a private key for the given
+// OPRF suite
+func checkPrivateKey(suite oprf.SuiteID, key *oprf.PrivateKey) error {
+	_, scalarLength, err := oprfSizes(suite)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return errors.New("missing private key")
+	}
+	serializedKey, err := key.Serialize()
+	if err != nil {
+		return err
+	}
+	if len(serializedKey) != scalarLength {
+		return errors.New("private key doesn't match OPRF suite")
+	}
+	return nil
+}
+
+// newOPRFServer returns an OPRF server for the given suite, mode and key
+func newOPRFServer(suite oprf.SuiteID, mode oprf.Mode, key *oprf.PrivateKey) (*oprf.Server, error) {
+	switch mode {
+	case oprf.BaseMode:
+		return oprf.NewServer(suite, key)
+	case oprf.VerifiableMode:
+		return oprf.NewVerifiableServer(suite, key)
+	default:
+		return nil, errors.New("unsupported OPRF mode")
+	}
+}
+
 // deriveBucketEntryKey derives a bucket entry key from a credential pair
-func (s *Server) deriveBucketEntryKey(username []byte, password []byte) ([]byte, error) {
+// under the key for epoch
+func (s *Server) deriveBucketEntryKey(epoch uint32, username []byte, password []byte) ([]byte, error) {
+	oprfServer, err := s.oprfServerForEpoch(epoch)
+	if err != nil {
+		return nil, err
+	}
 	input := s.slowHasher.Hash(serializeUsernamePassword(username, password))
-	return s.oprfServer.FullEvaluate(input, OprfInfo)
+	return oprfServer.FullEvaluate(input, evaluationInfo(s.publicInput, s.BucketID(username), epoch))
 }
 
 // BucketID returns the bucket ID for the given username
 func (s *Server) BucketID(username []byte) uint32 {
-	return bucketHashToID(s.bucketHasher.Hash(username), s.bucketIDBitSize)
+	return BucketHashToID(s.BucketHash(username), s.bucketIDBitSize)
+}
+
+// BucketHash returns the full bucket hash of the given username, from which
+// BucketHashToID derives its bucket ID for any bucket ID bit size
+func (s *Server) BucketHash(username []byte) []byte {
+	return s.bucketHasher.Hash(username)
+}
+
+// BucketKey returns the storage key of the bucket for the given username in
+// the current epoch. Entries from EncryptBucketEntry belong in this bucket.
+func (s *Server) BucketKey(username []byte) string {
+	return BucketKey(s.epoch, BucketIDToHex(s.BucketID(username)))
 }
 
 // EncryptBucketEntry performs the full OPRF and encryption of metadata, without any
-// blinding steps. This is useful for precomputing the buckets of encrypted
-// items. The return value is the bucket ID (2 byte hash of username) as well
+// blinding steps, under the key for the current epoch. This is useful for
+// precomputing the buckets of encrypted items. The return value is the bucket ID (2 byte hash of username) as well
 // as the ciphertext, both encoded as byte slices.
 func (s *Server) EncryptBucketEntry(username, password []byte, metadataFlag MetadataType, metadata []byte) ([]byte, error) {
 	if !metadataFlag.Valid() {
 		return nil, errors.New("invalid metadata flag value: " + string(metadataFlag))
 	}
-	key, err := s.deriveBucketEntryKey(username, password)
+	key, err := s.deriveBucketEntryKey(s.epoch, username, password)
 	if err != nil {
 		return nil, err
 	}
@@ -161,15 +355,62 @@ func (s *Server) EncryptBucketEntry(username, password []byte, metadataFlag Meta
 	return s.bucketEncryptor.Encrypt(key, metadataFlag, metadata)
 }
 
-// ServerResponse wraps up the server's response state.
+// RemoveBucketEntries splits the contents of a bucket for epoch into the
+// entries encrypted for username and any of the given passwords under the
+// key for that epoch, whatever their metadata, and the remaining contents.
+// A nil password matches the username-only entry. The epoch must be one of
+// Epochs.
+func (s *Server) RemoveBucketEntries(epoch uint32, contents, username []byte, passwords [][]byte) ([]byte, [][]byte, error) {
+	entries, err := SplitBucketEntries(contents)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make([][]byte, len(passwords))
+	for i, password := range passwords {
+		if keys[i], err = s.deriveBucketEntryKey(epoch, username, password); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	remaining := make([]byte, 0, len(contents))
+	var removed [][]byte
+	for _, entry := range entries {
+		matched := false
+		for _, key := range keys {
+			valid, _, _, err := s.bucketEncryptor.DecryptHeader(key, entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			if valid {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			removed = append(removed, entry)
+		} else {
+			remaining = append(remaining, entry...)
+		}
+	}
+	return remaining, removed, nil
+}
+
+// ServerResponse wraps up the server's response state. Proof is only set in
+// verifiable OPRF mode.
+// EvaluatedElements holds the evaluations of the request's BlindElements, in
+// order.
 type ServerResponse struct {
-	Version          uint32 `json:"version"`
-	EvaluatedElement []byte `json:"evaluatedElement"`
-	BucketContents   []byte `json:"bucketContents"`
+	Version           uint32   `json:"version"`
+	EvaluatedElement  []byte   `json:"evaluatedElement"`
+	EvaluatedElements [][]byte `json:"evaluatedElements,omitempty"`
+	Proof             []byte   `json:"proof,omitempty"`
+	BucketContents    []byte   `json:"bucketContents"`
 }
 
 // MarshalBinary marshals the server response in the following binary format:
-// <32-bit version>|<evaluated-element>|<bucket-contents>
+// <32-bit version>|<evaluated-element>|<evaluated-elements>|<proof>|<bucket-contents>
+// where the additional evaluated elements are empty for single-element
+// requests and the proof is empty in base OPRF mode.
 func (r *ServerResponse) MarshalBinary() ([]byte, error) {
 	buffer := new(bytes.Buffer)
 	if err := binary.Write(buffer, binary.BigEndian, r.Version); err != nil {
@@ -178,31 +419,61 @@ func (r *ServerResponse) MarshalBinary() ([]byte, error) {
 	if _, err := buffer.Write(r.EvaluatedElement); err != nil {
 		return nil, err
 	}
+	for _, element := range r.EvaluatedElements {
+		if _, err := buffer.Write(element); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := buffer.Write(r.Proof); err != nil {
+		return nil, err
+	}
 	if _, err := buffer.Write(r.BucketContents); err != nil {
 		return nil, err
 	}
 	return buffer.Bytes(), nil
 }
 
-// UnmarshalBinary unmarshals the server response from the following binary format:
-// <32-bit version>|<evaluated-element>|<bucket-contents>
-func (r *ServerResponse) UnmarshalBinary(data []byte) error {
+// ParseServerResponse unmarshals the server response to a request with the
+// given number of blinded elements for the given OPRF suite and mode from
+// the following binary format:
+// <32-bit version>|<evaluated-element>|<evaluated-elements>|<proof>|<bucket-contents>
+// The lengths of the fields depend on the suite, the mode and the number of
+// elements, none of which the response carries, so ServerResponse doesn't
+// implement encoding.BinaryUnmarshaler. Clients can use Client.ParseResponse
+// or ClientRequestContext.ParseResponse instead.
+func ParseServerResponse(data []byte, suite oprf.SuiteID, mode oprf.Mode, elements int) (ServerResponse, error) {
+	var r ServerResponse
 	buffer := bytes.NewBuffer(data)
 	if err := binary.Read(buffer, binary.BigEndian, &r.Version); err != nil {
-		return err
+		return ServerResponse{}, fmt.Errorf("%w: too few bytes to deserialize Version", ErrTruncatedResponse)
 	}
-	sizes, err := oprf.GetSizes(DefaultOPRFSuite)
+	elementLength, _, err := oprfSizes(suite)
 	if err != nil {
-		return err
+		return ServerResponse{}, err
 	}
-	r.EvaluatedElement = make([]byte, sizes.SerializedElementLength)
-	if n, err := buffer.Read(r.EvaluatedElement); err != nil {
-		return err
-	} else if n != len(r.EvaluatedElement) {
-		return errors.New("too few bytes to deserialize EvaluatedElement")
+	r.EvaluatedElement = make([]byte, elementLength)
+	if _, err := io.ReadFull(buffer, r.EvaluatedElement); err != nil {
+		return ServerResponse{}, fmt.Errorf("%w: too few bytes to deserialize EvaluatedElement", ErrTruncatedResponse)
+	}
+	for i := 1; i < elements; i++ {
+		element := make([]byte, elementLength)
+		if _, err := io.ReadFull(buffer, element); err != nil {
+			return ServerResponse{}, fmt.Errorf("%w: too few bytes to deserialize EvaluatedElements", ErrTruncatedResponse)
+		}
+		r.EvaluatedElements = append(r.EvaluatedElements, element)
+	}
+	if mode == oprf.VerifiableMode {
+		length, err := proofLength(suite)
+		if err != nil {
+			return ServerResponse{}, err
+		}
+		r.Proof = make([]byte, length)
+		if _, err := io.ReadFull(buffer, r.Proof); err != nil {
+			return ServerResponse{}, fmt.Errorf("%w: too few bytes to deserialize Proof", ErrTruncatedResponse)
+		}
 	}
 	r.BucketContents = buffer.Bytes()
-	return nil
+	return r, nil
 }
 
 // Getter defines the interface needed for fetching bucket items to insert into
@@ -212,6 +483,19 @@ type Getter interface {
 	Get(id string) ([]byte, error)
 }
 
+// parseBucketID decodes a hex bucket ID, checking that it is in range for the
+// server's bucket ID bit size
+func (s *Server) parseBucketID(bucketIDHex string) (uint32, error) {
+	bucketID, err := BucketIDFromHex(bucketIDHex)
+	if err != nil {
+		return 0, err
+	}
+	if s.bucketIDBitSize < 32 && bucketID >= 1<<s.bucketIDBitSize {
+		return 0, fmt.Errorf("%w: %s out of range for %d-bit bucket IDs", ErrInvalidBucketID, bucketIDHex, s.bucketIDBitSize)
+	}
+	return bucketID, nil
+}
+
 // HandleRequest takes as input a client request buffer and kv that implements
 // the Getter interface. The request is a JSON encoding of a bucket
 // identifier and oprf.IntValue  (a blinded group element) Should return a new
@@ -220,31 +504,69 @@ type Getter interface {
 // that is a protobuf encoding of an oprf.IntValue (the Eval'd blinded value)
 // plus the associated bucket
 func (s *Server) HandleRequest(request ClientRequest, kv Getter) (ServerResponse, error) {
-	if uint16(request.Version) != s.version {
-		return ServerResponse{}, errors.New("requested version doesn't match server version")
+	response, err := s.Evaluate(request)
+	if err != nil {
+		return ServerResponse{}, err
 	}
 
-	evaluation, err := s.oprfServer.Evaluate([]oprf.Blinded{request.BlindElement}, OprfInfo)
+	// Evaluate validated the bucket ID, which is looked up in canonical form
+	bucketID, err := BucketIDFromHex(request.BucketID)
 	if err != nil {
 		return ServerResponse{}, err
 	}
-	if len(evaluation.Elements) < 1 {
-		return ServerResponse{}, errors.New("invalid Evaluation response")
+	bucketKey := BucketKey(request.Epoch, BucketIDToHex(bucketID))
+	bucketContents, err := kv.Get(bucketKey)
+	if err != nil {
+		return ServerResponse{}, err
+	}
+	if response.BucketContents, err = s.PadBucket(bucketKey, bucketContents); err != nil {
+		return ServerResponse{}, err
+	}
+	return response, nil
+}
+
+// Evaluate evaluates the blinded elements of a client request without
+// fetching its bucket, for clients that fetch buckets separately, e.g. from
+// a static export. The response carries no bucket contents.
+func (s *Server) Evaluate(request ClientRequest) (ServerResponse, error) {
+	if uint16(request.Version) != s.version {
+		return ServerResponse{}, fmt.Errorf("%w: requested version doesn't match server version", ErrVersionMismatch)
 	}
 
-	_, err = hex.DecodeString(request.BucketID)
+	bucketID, err := s.parseBucketID(request.BucketID)
 	if err != nil {
-		return ServerResponse{}, errors.New("bucket ID not valid hex")
+		return ServerResponse{}, err
 	}
 
-	bucketContents, err := kv.Get(request.BucketID)
+	oprfServer, err := s.oprfServerForEpoch(request.Epoch)
 	if err != nil {
 		return ServerResponse{}, err
 	}
+	if len(request.BlindElements) >= MaxBlindElements {
+		return ServerResponse{}, fmt.Errorf("%w: too many blinded elements in request: %d", ErrMalformedElement, len(request.BlindElements)+1)
+	}
+	info := evaluationInfo(s.publicInput, bucketID, request.Epoch)
+	blinded := append([]oprf.Blinded{request.BlindElement}, request.BlindElements...)
+	evaluation, err := oprfServer.Evaluate(blinded, info)
+	if err != nil {
+		return ServerResponse{}, fmt.Errorf("%w: %v", ErrMalformedElement, err)
+	}
+	if len(evaluation.Elements) != len(blinded) {
+		return ServerResponse{}, errors.New("invalid Evaluation response")
+	}
 
-	return ServerResponse{
+	response := ServerResponse{
 		Version:          request.Version,
 		EvaluatedElement: evaluation.Elements[0],
-		BucketContents:   bucketContents,
-	}, nil
+	}
+	if len(evaluation.Elements) > 1 {
+		response.EvaluatedElements = evaluation.Elements[1:]
+	}
+	if s.oprfMode == oprf.VerifiableMode {
+		if evaluation.Proof == nil {
+			return ServerResponse{}, errors.New("missing proof in verifiable Evaluation response")
+		}
+		response.Proof = marshalProof(evaluation.Proof)
+	}
+	return response, nil
 }
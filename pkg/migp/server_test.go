@@ -5,8 +5,12 @@ package migp
 
 import (
 	"bytes"
-	"crypto/rand"
+	"encoding"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/cloudflare/circl/oprf"
@@ -59,36 +63,499 @@ func TestSerialization(t *testing.T) {
 	}
 }
 
-// TestServerResponseSerialization tests the serialization of a MIGP server response
+// TestServerResponseSerialization tests that a MIGP server response
+// round-trips through the exported parsers for each supported OPRF suite and
+// mode
 func TestServerResponseSerialization(t *testing.T) {
-	sizes, err := oprf.GetSizes(DefaultOPRFSuite)
+	username, password := []byte("test@mail.com"), []byte("password1234")
+	for _, suite := range OPRFSuites {
+		for _, mode := range []oprf.Mode{oprf.BaseMode, oprf.VerifiableMode} {
+			cfg := DefaultConfig()
+			cfg.OPRFSuite, cfg.OPRFMode = suite, mode
+			serverCfg, err := NewServerConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, err := NewServer(serverCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := NewClient(server.Config().Config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kv := &KVMock{store: make(map[string][]byte)}
+			entry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kv.store[server.BucketKey(username)] = entry
+
+			for _, combined := range []bool{false, true} {
+				request, ctx, err := client.Request(username, password)
+				if combined {
+					request, ctx, err = client.RequestCombined(username, password)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				r1, err := server.HandleRequest(request, kv)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := r1.MarshalBinary()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				r2, err := ctx.ParseResponse(data)
+				if err != nil {
+					t.Fatalf("suite %d, mode %d: %v", suite, mode, err)
+				}
+				if !reflect.DeepEqual(r1, r2) {
+					t.Fatalf("suite %d, mode %d, combined %v: mismatch", suite, mode, combined)
+				}
+				if !combined {
+					status, _, err := ctx.Finalize(r2)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if status != InBreach {
+						t.Fatalf("suite %d, mode %d: want %s, got %s", suite, mode, InBreach, status)
+					}
+					r3, err := client.ParseResponse(data)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(r1, r3) {
+						t.Fatalf("suite %d, mode %d: Client.ParseResponse mismatch", suite, mode)
+					}
+				}
+
+				elements := 1
+				if combined {
+					elements = 2
+				}
+				r4, err := ParseServerResponse(data, suite, mode, elements)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(r1, r4) {
+					t.Fatalf("suite %d, mode %d, combined %v: ParseServerResponse mismatch", suite, mode, combined)
+				}
+			}
+		}
+	}
+
+	if _, err := ParseServerResponse(make([]byte, 128), 0xffff, oprf.BaseMode, 1); err != oprf.ErrUnsupportedSuite {
+		t.Errorf("unsupported suite: got %v, expected %v", err, oprf.ErrUnsupportedSuite)
+	}
+
+	// the encoding can't be parsed without the suite, mode and element count
+	if _, ok := interface{}(new(ServerResponse)).(encoding.BinaryUnmarshaler); ok {
+		t.Error("ServerResponse implements encoding.BinaryUnmarshaler")
+	}
+}
+
+// TestSerializationPreviousKey tests that a server configuration in the
+// middle of a key rotation can be serialized and deserialized
+func TestSerializationPreviousKey(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.Epoch = 3
+	cfg.PreviousPrivateKey = DefaultServerConfig().PrivateKey
+	server, err := NewServer(cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
-	r1 := ServerResponse{
-		123,
-		make([]byte, sizes.SerializedElementLength),
-		[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9},
+
+	buf, err := json.Marshal(server.Config())
+	if err != nil {
+		t.Fatal(err)
 	}
-	if _, err := rand.Read(r1.EvaluatedElement); err != nil {
+	var cfg2 ServerConfig
+	if err := json.Unmarshal(buf, &cfg2); err != nil {
 		t.Fatal(err)
 	}
-	data, err := r1.MarshalBinary()
+	if cfg2.Epoch != cfg.Epoch || cfg2.PreviousPrivateKey == nil {
+		t.Fatal("serialization failed: epoch or previous key missing")
+	}
+	previousKey, err := cfg.PreviousPrivateKey.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousKey2, err := cfg2.PreviousPrivateKey.Serialize()
 	if err != nil {
 		t.Fatal(err)
 	}
-	expectedLen := 4 + len(r1.EvaluatedElement) + len(r1.BucketContents)
-	if len(data) != expectedLen {
-		t.Fatalf("want %d, got %d", expectedLen, len(data))
+	if !bytes.Equal(previousKey, previousKey2) {
+		t.Error("serialization failed: previous key not equal")
+	}
+
+	cfg.Epoch = 0
+	if _, err := NewServer(cfg); err == nil {
+		t.Error("expected error for previous key in epoch zero")
+	}
+}
+
+// TestServerConfigSuites tests that server configurations are only accepted
+// with a private key for the configured OPRF suite
+func TestServerConfigSuites(t *testing.T) {
+	for _, suite := range OPRFSuites {
+		cfg := DefaultConfig()
+		cfg.OPRFSuite = suite
+		serverCfg, err := NewServerConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewServer(serverCfg); err != nil {
+			t.Errorf("suite %d: %v", suite, err)
+		}
+		for _, other := range OPRFSuites {
+			if other == suite {
+				continue
+			}
+			serverCfg.OPRFSuite = other
+			if _, err := NewServer(serverCfg); err == nil {
+				t.Errorf("suite %d: expected error for private key of suite %d", other, suite)
+			}
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.OPRFSuite = 0xffff
+	if _, err := NewServerConfig(cfg); err == nil {
+		t.Error("expected error for unsupported suite")
+	}
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("expected error for unsupported suite")
+	}
+}
+
+// TestBucketPadding tests that served buckets are padded to the configured
+// number of entries and shuffled, and that stored entries are still found
+func TestBucketPadding(t *testing.T) {
+	username := []byte("username1")
+	testCases := []struct {
+		padding  PaddingConfig
+		stored   int
+		expected int
+	}{
+		{PaddingConfig{}, 3, 3},
+		{PaddingConfig{}, 8, 8},
+		{PaddingConfig{Policy: PaddingFixed, Entries: 8}, 0, 8},
+		{PaddingConfig{Policy: PaddingFixed, Entries: 8}, 3, 8},
+		{PaddingConfig{Policy: PaddingFixed, Entries: 8}, 8, 8},
+		{PaddingConfig{Policy: PaddingPowerOfTwo}, 5, 8},
+		{PaddingConfig{Policy: PaddingPowerOfTwo, Entries: 16}, 5, 16},
+		{PaddingConfig{Policy: PaddingPowerOfTwo, Entries: 4}, 0, 4},
+	}
+
+	for _, test := range testCases {
+		for _, encryptorID := range []uint16{BucketEncryptorHKDFSHA256, BucketEncryptorAES256GCM} {
+			cfg := DefaultConfig()
+			cfg.SlowHasherID = SlowHasherNull
+			cfg.BucketEncryptorID = encryptorID
+			serverCfg, err := NewServerConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a fixed key makes the shuffle deterministic
+			if serverCfg.PrivateKey, err = oprf.DeriveKey(cfg.OPRFSuite, cfg.OPRFMode, []byte("padding test key")); err != nil {
+				t.Fatal(err)
+			}
+			serverCfg.Padding = test.padding
+			server, err := NewServer(serverCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var stored [][]byte
+			kv := &KVMock{store: make(map[string][]byte)}
+			for i := 0; i < test.stored; i++ {
+				password := []byte(fmt.Sprintf("password%d", i))
+				newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, []byte(fmt.Sprintf("breach %d", i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				stored = append(stored, newEntry)
+				kv.store[server.BucketKey(username)] = append(kv.store[server.BucketKey(username)], newEntry...)
+			}
+
+			client, err := NewClient(server.Config().Config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			password := []byte(fmt.Sprintf("password%d", test.stored-1))
+			request, clientFinalize, err := client.Request(username, password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := server.HandleRequest(request, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := SplitBucketEntries(response.BucketContents)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != test.expected {
+				t.Errorf("padding %+v, %d stored: want %d entries, got %d", test.padding, test.stored, test.expected, len(entries))
+			}
+
+			// every stored entry is served, and stored entries don't keep
+			// their insertion order
+			inOrder := true
+			for i, entry := range stored {
+				found := -1
+				for j := range entries {
+					if bytes.Equal(entries[j], entry) {
+						found = j
+					}
+				}
+				if found < 0 {
+					t.Fatalf("padding %+v: stored entry %d missing", test.padding, i)
+				}
+				inOrder = inOrder && found == i
+			}
+			if test.expected >= 8 && test.stored > 1 && inOrder {
+				t.Errorf("padding %+v: stored entries served in insertion order", test.padding)
+			}
+
+			// responses are deterministic
+			again, err := server.HandleRequest(request, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(response.BucketContents, again.BucketContents) {
+				t.Errorf("padding %+v: responses differ", test.padding)
+			}
+
+			status, _, err := clientFinalize.Finalize(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedStatus := InBreach
+			if test.stored == 0 {
+				expectedStatus = NotInBreach
+			}
+			if status != expectedStatus {
+				t.Errorf("padding %+v: want status %d, got %d", test.padding, expectedStatus, status)
+			}
+		}
 	}
 
-	r2 := ServerResponse{}
+	serverCfg := DefaultServerConfig()
+	serverCfg.Padding = PaddingConfig{Policy: "random"}
+	if _, err := NewServer(serverCfg); err == nil {
+		t.Error("expected error for unsupported padding policy")
+	}
+}
 
-	if err = r2.UnmarshalBinary(data); err != nil {
+// TestBucketPaddingTooLarge tests that buckets holding more entries than the
+// fixed padding size are refused rather than served at their true size
+func TestBucketPaddingTooLarge(t *testing.T) {
+	username := []byte("username1")
+	serverCfg := DefaultServerConfig()
+	serverCfg.Padding = PaddingConfig{Policy: PaddingFixed, Entries: 2}
+	server, err := NewServer(serverCfg)
+	if err != nil {
 		t.Fatal(err)
 	}
+	kv := &KVMock{store: make(map[string][]byte)}
+	bucketKey := server.BucketKey(username)
+	for i := 0; i < 3; i++ {
+		newEntry, err := server.EncryptBucketEntry(username, []byte(fmt.Sprintf("password%d", i)), MetadataBreachedPassword, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kv.store[bucketKey] = append(kv.store[bucketKey], newEntry...)
+	}
 
-	if r1.Version != r2.Version || !bytes.Equal(r1.EvaluatedElement, r2.EvaluatedElement) || !bytes.Equal(r1.BucketContents, r2.BucketContents) {
-		t.Fatal("mismatch")
+	client, err := NewClient(server.Config().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request(username, []byte("password0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.HandleRequest(request, kv); !errors.Is(err, ErrBucketTooLarge) {
+		t.Errorf("HandleRequest: want %v, got %v", ErrBucketTooLarge, err)
+	}
+	if _, err := server.PadBucket(bucketKey, kv.store[bucketKey]); !errors.Is(err, ErrBucketTooLarge) {
+		t.Errorf("PadBucket: want %v, got %v", ErrBucketTooLarge, err)
+	}
+	if err := serverCfg.Padding.CheckEntries(3); !errors.Is(err, ErrBucketTooLarge) {
+		t.Errorf("CheckEntries: want %v, got %v", ErrBucketTooLarge, err)
+	}
+	if err := serverCfg.Padding.CheckEntries(2); err != nil {
+		t.Errorf("CheckEntries: %v", err)
+	}
+}
+
+// TestHandleRequestErrors checks that invalid requests fail with the
+// matching sentinel error
+func TestHandleRequestErrors(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(server.Config().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, password := []byte("test@mail.com"), []byte("password1234")
+	newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: map[string][]byte{server.BucketKey(username): newEntry}}
+	request, context, err := client.Request(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maxBucketID := BucketIDToHex(1<<DefaultBucketIDBitSize - 1)
+	tests := []struct {
+		modify func(*ClientRequest)
+		err    error
+	}{
+		{func(r *ClientRequest) { r.Version++ }, ErrVersionMismatch},
+		{func(r *ClientRequest) { r.BucketID = "xyz" }, ErrInvalidBucketID},
+		{func(r *ClientRequest) { r.BucketID = "0001" }, ErrInvalidBucketID},
+		{func(r *ClientRequest) { r.BucketID = BucketIDToHex(1 << DefaultBucketIDBitSize) }, ErrInvalidBucketID},
+		{func(r *ClientRequest) { r.BucketID = maxBucketID }, nil},
+		{func(r *ClientRequest) { r.BlindElement = []byte{1, 2, 3} }, ErrMalformedElement},
+		{func(r *ClientRequest) { r.BlindElements = make([][]byte, MaxBlindElements) }, ErrMalformedElement},
+		{func(r *ClientRequest) { r.Epoch = 5 }, ErrUnknownEpoch},
+	}
+	for i, test := range tests {
+		r := request
+		test.modify(&r)
+		if _, err := server.HandleRequest(r, kv); !errors.Is(err, test.err) {
+			t.Errorf("failed test %d: want %v, got %v", i, test.err, err)
+		}
+	}
+
+	// bucket IDs are looked up in canonical form
+	r := request
+	r.BucketID = strings.ToUpper(r.BucketID)
+	response, err := server.HandleRequest(r, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, err := context.Finalize(response); err != nil || status != InBreach {
+		t.Errorf("upper case bucket ID: want %s, got %s %v", InBreach, status, err)
+	}
+
+	// responses with the wrong version or element count are rejected
+	wrongVersion := response
+	wrongVersion.Version++
+	if _, _, err := context.Finalize(wrongVersion); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("want %v, got %v", ErrVersionMismatch, err)
+	}
+	extraElement := response
+	extraElement.EvaluatedElements = [][]byte{response.EvaluatedElement}
+	if _, _, err := context.Finalize(extraElement); !errors.Is(err, ErrMalformedElement) {
+		t.Errorf("want %v, got %v", ErrMalformedElement, err)
+	}
+}
+
+// TestServerResponseTruncated checks that truncated server responses fail
+// with ErrTruncatedResponse
+func TestServerResponseTruncated(t *testing.T) {
+	elementLength, scalarLength, err := oprfSizes(DefaultOPRFSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		length   int
+		mode     oprf.Mode
+		elements int
+	}{
+		{3, oprf.BaseMode, 1},
+		{4 + elementLength - 1, oprf.BaseMode, 1},
+		{4 + 2*elementLength - 1, oprf.BaseMode, 2},
+		{4 + elementLength + 2*scalarLength - 1, oprf.VerifiableMode, 1},
+	} {
+		if _, err := ParseServerResponse(make([]byte, test.length), DefaultOPRFSuite, test.mode, test.elements); !errors.Is(err, ErrTruncatedResponse) {
+			t.Errorf("%d bytes, mode %d, %d elements: want %v, got %v", test.length, test.mode, test.elements, ErrTruncatedResponse, err)
+		}
+	}
+}
+
+// TestRemoveBucketEntries removes the entries for a credential pair from a
+// bucket, whatever their metadata
+func TestRemoveBucketEntries(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := []byte("username")
+	entries := []struct {
+		username, password []byte
+		flag               MetadataType
+		metadata           []byte
+		removed            bool
+	}{
+		{username, []byte("password1"), MetadataBreachedPassword, []byte("breach"), true},
+		{username, nil, MetadataBreachedUsername, nil, true},
+		{username, []byte("password2"), MetadataSimilarPassword, []byte("breach"), false},
+		{[]byte("other"), []byte("password1"), MetadataBreachedPassword, nil, false},
+	}
+	var contents, wantRemaining []byte
+	var wantRemoved [][]byte
+	for _, e := range entries {
+		entry, err := server.EncryptBucketEntry(e.username, e.password, e.flag, e.metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, entry...)
+		if e.removed {
+			wantRemoved = append(wantRemoved, entry)
+		} else {
+			wantRemaining = append(wantRemaining, entry...)
+		}
+	}
+
+	remaining, removed, err := server.RemoveBucketEntries(server.Epoch(), contents, username, [][]byte{[]byte("password1"), nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(remaining, wantRemaining) {
+		t.Error("remaining contents differ")
+	}
+	if len(removed) != len(wantRemoved) {
+		t.Fatalf("want %d removed entries, got %d", len(wantRemoved), len(removed))
+	}
+	for i := range removed {
+		if !bytes.Equal(removed[i], wantRemoved[i]) {
+			t.Errorf("removed entry %d differs", i)
+		}
+	}
+
+	if _, _, err := server.RemoveBucketEntries(server.Epoch(), []byte("not a bucket"), username, [][]byte{nil}); err == nil {
+		t.Error("expected error for malformed bucket")
+	}
+	if _, _, err := server.RemoveBucketEntries(server.Epoch()+1, contents, username, [][]byte{nil}); !errors.Is(err, ErrUnknownEpoch) {
+		t.Errorf("want %v, got %v", ErrUnknownEpoch, err)
+	}
+
+	// during a key rotation, entries are removed under the previous key too
+	previous := DefaultServerConfig()
+	previous.Epoch = 1
+	previous.PreviousPrivateKey = server.Config().PrivateKey
+	rotated, err := NewServer(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epochs := rotated.Epochs(); len(epochs) != 2 || epochs[0] != 1 || epochs[1] != 0 {
+		t.Fatalf("want epochs [1 0], got %v", epochs)
+	}
+	if _, removed, err = rotated.RemoveBucketEntries(0, contents, username, [][]byte{[]byte("password1"), nil}); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != len(wantRemoved) {
+		t.Fatalf("previous epoch: want %d removed entries, got %d", len(wantRemoved), len(removed))
 	}
 }
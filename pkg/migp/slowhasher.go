@@ -5,26 +5,153 @@ package migp
 
 import (
 	"errors"
+	"fmt"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/scrypt"
 )
 
 const (
-	SlowHasherNull   uint16 = 0x0000
-	SlowHasherScrypt uint16 = 0x0001
+	SlowHasherNull     uint16 = 0x0000
+	SlowHasherScrypt   uint16 = 0x0001
+	SlowHasherArgon2id uint16 = 0x0002
 )
 
 const (
-	SlowHashSalt = "MIGP slow hash"
-	SlowHashLen  = 32    // scrypt number of bytes of output to request
-	ScryptN      = 16384 // scrypt N
-	Scryptr      = 8     // scrypt r
-	Scryptp      = 1     // scrypt p
+	SlowHashSalt    = "MIGP slow hash"
+	SlowHashLen     = 32        // scrypt number of bytes of output to request
+	ScryptN         = 16384     // scrypt N
+	Scryptr         = 8         // scrypt r
+	Scryptp         = 1         // scrypt p
+	Argon2idTime    = 3         // argon2id number of passes
+	Argon2idMemory  = 64 * 1024 // argon2id memory in KiB
+	Argon2idThreads = 4         // argon2id degree of parallelism
 )
 
+// Bounds on slow hash parameters accepted by NewSlowHasher. The minimums keep
+// the hash expensive enough to slow down offline guessing, and the maximums
+// keep a configuration fetched from a server from exhausting client
+// resources. Memory is capped at 256 MiB per hash, which browsers and phones
+// can still allocate.
+const (
+	MinSlowHashSaltLen = 8
+	MaxSlowHashSaltLen = 64
+	MinSlowHashLen     = 16
+	MaxSlowHashLen     = 64
+	MinScryptN         = 1 << 14
+	MaxScryptN         = 1 << 20
+	MaxScryptr         = 32
+	MaxScryptp         = 16
+	MaxScryptMemory    = 256 << 20 // 128 * N * r, in bytes
+	MinArgon2idTime    = 1
+	MaxArgon2idTime    = 10
+	MinArgon2idMemory  = 19 * 1024  // in KiB
+	MaxArgon2idMemory  = 256 * 1024 // in KiB
+	MaxArgon2idThreads = 16
+)
+
+// SlowHashParams holds the cost parameters and salt of a slow hasher. Zero
+// fields take the default value for the slow hasher, and fields that don't
+// apply to it are ignored.
+type SlowHashParams struct {
+	Salt   string `json:"salt,omitempty"`
+	Length uint32 `json:"length,omitempty"`
+
+	// scrypt
+	N int `json:"n,omitempty"`
+	R int `json:"r,omitempty"`
+	P int `json:"p,omitempty"`
+
+	// Argon2id, with Memory in KiB
+	Time    uint32 `json:"time,omitempty"`
+	Memory  uint32 `json:"memory,omitempty"`
+	Threads uint8  `json:"threads,omitempty"`
+}
+
+// withDefaults returns the parameters with zero fields set to their default
+// for the slow hasher with the given ID, and fields that don't apply to it
+// cleared
+func (p SlowHashParams) withDefaults(id uint16) SlowHashParams {
+	switch id {
+	case SlowHasherScrypt, SlowHasherArgon2id:
+	default:
+		return SlowHashParams{}
+	}
+	if p.Salt == "" {
+		p.Salt = SlowHashSalt
+	}
+	if p.Length == 0 {
+		p.Length = SlowHashLen
+	}
+	if id == SlowHasherScrypt {
+		p.Time, p.Memory, p.Threads = 0, 0, 0
+		if p.N == 0 {
+			p.N = ScryptN
+		}
+		if p.R == 0 {
+			p.R = Scryptr
+		}
+		if p.P == 0 {
+			p.P = Scryptp
+		}
+	} else {
+		p.N, p.R, p.P = 0, 0, 0
+		if p.Time == 0 {
+			p.Time = Argon2idTime
+		}
+		if p.Memory == 0 {
+			p.Memory = Argon2idMemory
+		}
+		if p.Threads == 0 {
+			p.Threads = Argon2idThreads
+		}
+	}
+	return p
+}
+
+// validate returns an error if the parameters are out of bounds for the slow
+// hasher with the given ID
+func (p SlowHashParams) validate(id uint16) error {
+	if id != SlowHasherScrypt && id != SlowHasherArgon2id {
+		return nil
+	}
+	if len(p.Salt) < MinSlowHashSaltLen || len(p.Salt) > MaxSlowHashSaltLen {
+		return fmt.Errorf("slow hash salt length %d out of bounds [%d, %d]", len(p.Salt), MinSlowHashSaltLen, MaxSlowHashSaltLen)
+	}
+	if p.Length < MinSlowHashLen || p.Length > MaxSlowHashLen {
+		return fmt.Errorf("slow hash length %d out of bounds [%d, %d]", p.Length, MinSlowHashLen, MaxSlowHashLen)
+	}
+	if id == SlowHasherScrypt {
+		if p.N < MinScryptN || p.N > MaxScryptN || p.N&(p.N-1) != 0 {
+			return fmt.Errorf("scrypt N %d must be a power of two in [%d, %d]", p.N, MinScryptN, MaxScryptN)
+		}
+		if p.R < 1 || p.R > MaxScryptr {
+			return fmt.Errorf("scrypt r %d out of bounds [1, %d]", p.R, MaxScryptr)
+		}
+		if p.P < 1 || p.P > MaxScryptp {
+			return fmt.Errorf("scrypt p %d out of bounds [1, %d]", p.P, MaxScryptp)
+		}
+		if 128*p.N*p.R > MaxScryptMemory {
+			return fmt.Errorf("scrypt memory %d bytes exceeds %d", 128*p.N*p.R, MaxScryptMemory)
+		}
+		return nil
+	}
+	if p.Time < MinArgon2idTime || p.Time > MaxArgon2idTime {
+		return fmt.Errorf("argon2id time %d out of bounds [%d, %d]", p.Time, MinArgon2idTime, MaxArgon2idTime)
+	}
+	if p.Memory < MinArgon2idMemory || p.Memory > MaxArgon2idMemory {
+		return fmt.Errorf("argon2id memory %d KiB out of bounds [%d, %d]", p.Memory, MinArgon2idMemory, MaxArgon2idMemory)
+	}
+	if p.Threads < 1 || p.Threads > MaxArgon2idThreads {
+		return fmt.Errorf("argon2id threads %d out of bounds [1, %d]", p.Threads, MaxArgon2idThreads)
+	}
+	return nil
+}
+
 // SlowHasher is a generic interface for a slow (memory hard) hash algorithm
 type SlowHasher interface {
 	ID() uint16
+	Params() SlowHashParams
 	Hash([]byte) []byte
 }
 
@@ -58,6 +185,11 @@ func (h scryptSlowHasher) ID() uint16 {
 	return SlowHasherScrypt
 }
 
+// Params returns the parameters of this particular hash function
+func (h scryptSlowHasher) Params() SlowHashParams {
+	return SlowHashParams{Salt: h.salt, Length: uint32(h.L), N: h.N, R: h.r, P: h.p}
+}
+
 // Hash applies scrypt, with the corresponding parameters, to the input buf
 func (h scryptSlowHasher) Hash(buf []byte) []byte {
 	temp, err := scrypt.Key(buf, []byte(h.salt), h.N, h.r, h.p, h.L)
@@ -70,6 +202,46 @@ func (h scryptSlowHasher) Hash(buf []byte) []byte {
 	return temp[:]
 }
 
+// argon2idSlowHasher implements SlowHasher using Argon2id
+type argon2idSlowHasher struct {
+	salt    string
+	time    uint32
+	memory  uint32
+	threads uint8
+	L       uint32
+}
+
+// NewArgon2idSlowHasher returns a SlowHasher instance using Argon2id with
+// the second recommended option from RFC 9106:
+// - t: 3
+// - m: 64 MiB
+// - p: 4
+// See: https://www.rfc-editor.org/rfc/rfc9106.html#section-4
+func NewArgon2idSlowHasher() argon2idSlowHasher {
+	return argon2idSlowHasher{
+		salt:    SlowHashSalt,
+		time:    Argon2idTime,
+		memory:  Argon2idMemory,
+		threads: Argon2idThreads,
+		L:       SlowHashLen,
+	}
+}
+
+// ID returns the identifier of this particular hash function
+func (h argon2idSlowHasher) ID() uint16 {
+	return SlowHasherArgon2id
+}
+
+// Params returns the parameters of this particular hash function
+func (h argon2idSlowHasher) Params() SlowHashParams {
+	return SlowHashParams{Salt: h.salt, Length: h.L, Time: h.time, Memory: h.memory, Threads: h.threads}
+}
+
+// Hash applies Argon2id, with the corresponding parameters, to the input buf
+func (h argon2idSlowHasher) Hash(buf []byte) []byte {
+	return argon2.IDKey(buf, []byte(h.salt), h.time, h.memory, h.threads, h.L)
+}
+
 // nullSlowHasher implements SlowHasher using a no-op
 type nullSlowHasher struct{}
 
@@ -83,18 +255,44 @@ func (h nullSlowHasher) ID() uint16 {
 	return SlowHasherNull
 }
 
+// Params returns the parameters of this particular hash function, of which
+// there are none
+func (h nullSlowHasher) Params() SlowHashParams {
+	return SlowHashParams{}
+}
+
 // Hash is a no-op, returning the input buf unmodified
 func (h nullSlowHasher) Hash(buf []byte) []byte {
 	return buf
 }
 
-// NewHasher returns an slow hasher given its ID
-func NewSlowHasher(id uint16) (SlowHasher, error) {
+// NewHasher returns an slow hasher given its ID and parameters. Zero
+// parameters take their default value, and an error is returned if the
+// resulting parameters are out of bounds.
+func NewSlowHasher(id uint16, params SlowHashParams) (SlowHasher, error) {
+	params = params.withDefaults(id)
+	if err := params.validate(id); err != nil {
+		return nil, err
+	}
 	switch id {
 	case SlowHasherNull:
 		return NewNullSlowHasher(), nil
 	case SlowHasherScrypt:
-		return NewScryptSlowHasher(), nil
+		return scryptSlowHasher{
+			salt: params.Salt,
+			N:    params.N,
+			r:    params.R,
+			p:    params.P,
+			L:    int(params.Length),
+		}, nil
+	case SlowHasherArgon2id:
+		return argon2idSlowHasher{
+			salt:    params.Salt,
+			time:    params.Time,
+			memory:  params.Memory,
+			threads: params.Threads,
+			L:       params.Length,
+		}, nil
 	default:
 		return nil, errors.New("Unsupported slow hasher")
 	}
@@ -3,7 +3,160 @@
 
 package migp
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+)
+
+// TestNewSlowHasher checks that each registered slow hasher is deterministic
+// and reports its own ID
+func TestNewSlowHasher(t *testing.T) {
+	input := []byte("username password")
+	for _, id := range []uint16{SlowHasherNull, SlowHasherScrypt, SlowHasherArgon2id} {
+		slowHasher, err := NewSlowHasher(id, SlowHashParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slowHasher.ID() != id {
+			t.Errorf("ID: want %d, got %d", id, slowHasher.ID())
+		}
+		output := slowHasher.Hash(input)
+		if !bytes.Equal(output, slowHasher.Hash(input)) {
+			t.Errorf("slow hasher %d is not deterministic", id)
+		}
+		if id != SlowHasherNull && len(output) != SlowHashLen {
+			t.Errorf("slow hasher %d: want %d bytes, got %d", id, SlowHashLen, len(output))
+		}
+	}
+	if _, err := NewSlowHasher(0xffff, SlowHashParams{}); err == nil {
+		t.Error("expected error for unsupported slow hasher")
+	}
+}
+
+// TestSlowHashMemoryBounds checks that configurations just within the slow
+// hash memory limits are accepted, and those just above them are refused
+func TestSlowHashMemoryBounds(t *testing.T) {
+	for _, test := range []struct {
+		id     uint16
+		params SlowHashParams
+		valid  bool
+	}{
+		{SlowHasherScrypt, SlowHashParams{N: 1 << 18, R: 7}, true},
+		{SlowHasherScrypt, SlowHashParams{N: 1 << 18, R: 8}, true},
+		{SlowHasherScrypt, SlowHashParams{N: 1 << 18, R: 9}, false},
+		{SlowHasherScrypt, SlowHashParams{N: 1 << 20, R: 2}, true},
+		{SlowHasherScrypt, SlowHashParams{N: 1 << 20, R: 3}, false},
+		{SlowHasherArgon2id, SlowHashParams{Memory: MaxArgon2idMemory - 1}, true},
+		{SlowHasherArgon2id, SlowHashParams{Memory: MaxArgon2idMemory}, true},
+		{SlowHasherArgon2id, SlowHashParams{Memory: MaxArgon2idMemory + 1}, false},
+	} {
+		_, err := NewSlowHasher(test.id, test.params)
+		if test.valid && err != nil {
+			t.Errorf("slow hasher %d, %+v: %v", test.id, test.params, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("slow hasher %d: expected error for %+v", test.id, test.params)
+		}
+	}
+}
+
+// TestSlowHashParams checks that slow hash parameters are validated and
+// honoured, and that clients and servers agree on them through Config
+func TestSlowHashParams(t *testing.T) {
+	input := []byte("username password")
+
+	invalid := []struct {
+		id     uint16
+		params SlowHashParams
+	}{
+		{SlowHasherScrypt, SlowHashParams{Salt: "short"}},
+		{SlowHasherScrypt, SlowHashParams{Length: 8}},
+		{SlowHasherScrypt, SlowHashParams{Length: 128}},
+		{SlowHasherScrypt, SlowHashParams{N: 1024}},
+		{SlowHasherScrypt, SlowHashParams{N: 20000}},
+		{SlowHasherScrypt, SlowHashParams{N: 1 << 21}},
+		{SlowHasherScrypt, SlowHashParams{R: 64}},
+		{SlowHasherScrypt, SlowHashParams{P: 32}},
+		{SlowHasherScrypt, SlowHashParams{N: 1 << 20, R: 16}},
+		{SlowHasherArgon2id, SlowHashParams{Time: 11}},
+		{SlowHasherArgon2id, SlowHashParams{Memory: 1024}},
+		{SlowHasherArgon2id, SlowHashParams{Memory: 2 * 1024 * 1024}},
+		{SlowHasherArgon2id, SlowHashParams{Threads: 32}},
+	}
+	for _, test := range invalid {
+		if _, err := NewSlowHasher(test.id, test.params); err == nil {
+			t.Errorf("slow hasher %d: expected error for %+v", test.id, test.params)
+		}
+	}
+
+	for _, id := range []uint16{SlowHasherScrypt, SlowHasherArgon2id} {
+		defaultHasher, err := NewSlowHasher(id, SlowHashParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		params := defaultHasher.Params()
+		params.Salt = "custom slow hash salt"
+		params.Length = 48
+		slowHasher, err := NewSlowHasher(id, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slowHasher.Params() != params {
+			t.Errorf("slow hasher %d: params want %+v, got %+v", id, params, slowHasher.Params())
+		}
+		output := slowHasher.Hash(input)
+		if len(output) != 48 || bytes.Equal(output[:SlowHashLen], defaultHasher.Hash(input)) {
+			t.Errorf("slow hasher %d: parameters not honoured", id)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.SlowHashParams = SlowHashParams{Salt: "custom slow hash salt", N: 1 << 15}
+	serverCfg, err := NewServerConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg := server.Config().Config
+	if clientCfg.SlowHashParams.N != 1<<15 || clientCfg.SlowHashParams.R != Scryptr {
+		t.Errorf("config params: got %+v", clientCfg.SlowHashParams)
+	}
+	username, password := []byte("username"), []byte("password")
+	newEntry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: map[string][]byte{server.BucketKey(username): newEntry}}
+	for _, test := range []struct {
+		cfg    Config
+		status BreachStatus
+	}{
+		{clientCfg, InBreach},
+		{DefaultConfig(), NotInBreach},
+	} {
+		client, err := NewClient(test.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, clientFinalize, err := client.Request(username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := server.HandleRequest(request, kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _, err := clientFinalize.Finalize(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.status {
+			t.Errorf("params %+v: want %d, got %d", test.cfg.SlowHashParams, test.status, status)
+		}
+	}
+}
 
 // BenchmarkScryptSlowHasher runs benchmark tests for the scrypt slow hasher
 func BenchmarkScryptSlowHasher(b *testing.B) {
@@ -14,3 +167,13 @@ func BenchmarkScryptSlowHasher(b *testing.B) {
 		_ = slowHasher.Hash(input)
 	}
 }
+
+// BenchmarkArgon2idSlowHasher runs benchmark tests for the Argon2id slow hasher
+func BenchmarkArgon2idSlowHasher(b *testing.B) {
+	input := []byte{32}
+
+	slowHasher := NewArgon2idSlowHasher()
+	for i := 0; i < b.N; i++ {
+		_ = slowHasher.Hash(input)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// SnapshotVersion1 is the version of the snapshot format written by
+// WriteSnapshot
+const SnapshotVersion1 = 0x01
+
+// snapshotMagic starts every snapshot file
+var snapshotMagic = []byte("MIGPSNAP")
+
+const (
+	// maxSnapshotConfigSize bounds the size of the configuration in a
+	// snapshot header
+	maxSnapshotConfigSize = 1 << 20
+
+	// snapshotIndexEntrySize is the size of an index entry without its key
+	snapshotIndexEntrySize = 2 + 8 + 8
+)
+
+// ErrMalformedSnapshot is returned when reading a snapshot that is truncated
+// or otherwise not in the snapshot format
+var ErrMalformedSnapshot = errors.New("malformed snapshot")
+
+// snapshotEntry locates the contents of a bucket in a snapshot, relative to
+// the start of the contents section
+type snapshotEntry struct {
+	Offset, Length uint64
+}
+
+// Snapshot is a read-only, single-file copy of a server's buckets, for
+// querying without access to a MIGP server. It implements Getter, so that
+// anyone holding the OPRF key can answer queries from it with
+// Server.HandleRequest.
+//
+// A snapshot consists of a header, an index and the bucket contents:
+//
+//	"MIGPSNAP" | <u8 version> | <u32 config length> | <config JSON> |
+//	<u32 bucket count> | (<u16 key length> | <key> | <u64 offset> | <u64 length>)* |
+//	<bucket contents>
+//
+// Integers are big-endian, index entries are in ascending key order, and
+// offsets are relative to the start of the bucket contents.
+type Snapshot struct {
+	// Config is the client configuration of the server the snapshot was
+	// taken from
+	Config Config
+
+	r        io.ReaderAt
+	closer   io.Closer
+	index    map[string]snapshotEntry
+	keys     []string
+	contents int64
+}
+
+// OpenSnapshot opens the snapshot file at path
+func OpenSnapshot(path string) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	snapshot, err := NewSnapshot(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	snapshot.closer = f
+	return snapshot, nil
+}
+
+// NewSnapshot reads the header and index of the size-byte snapshot in r.
+// Bucket contents are read from r as they are requested.
+func NewSnapshot(r io.ReaderAt, size int64) (*Snapshot, error) {
+	buffer := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(buffer, header); err != nil {
+		return nil, fmt.Errorf("%w: truncated header", ErrMalformedSnapshot)
+	}
+	if string(header[:len(snapshotMagic)]) != string(snapshotMagic) {
+		return nil, fmt.Errorf("%w: bad magic", ErrMalformedSnapshot)
+	}
+	if version := header[len(snapshotMagic)]; version != SnapshotVersion1 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrMalformedSnapshot, version)
+	}
+	read := int64(len(header))
+
+	var configLength uint32
+	if err := binary.Read(buffer, binary.BigEndian, &configLength); err != nil {
+		return nil, fmt.Errorf("%w: truncated header", ErrMalformedSnapshot)
+	}
+	if configLength > maxSnapshotConfigSize || int64(configLength) > size {
+		return nil, fmt.Errorf("%w: config too long", ErrMalformedSnapshot)
+	}
+	configData := make([]byte, configLength)
+	if _, err := io.ReadFull(buffer, configData); err != nil {
+		return nil, fmt.Errorf("%w: truncated config", ErrMalformedSnapshot)
+	}
+	s := &Snapshot{r: r}
+	if err := json.Unmarshal(configData, &s.Config); err != nil {
+		return nil, fmt.Errorf("%w: bad config: %v", ErrMalformedSnapshot, err)
+	}
+	read += 4 + int64(configLength)
+
+	var count uint32
+	if err := binary.Read(buffer, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("%w: truncated index", ErrMalformedSnapshot)
+	}
+	read += 4
+	if int64(count) > (size-read)/snapshotIndexEntrySize {
+		return nil, fmt.Errorf("%w: too many index entries", ErrMalformedSnapshot)
+	}
+	s.index = make(map[string]snapshotEntry, count)
+	s.keys = make([]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var keyLength uint16
+		if err := binary.Read(buffer, binary.BigEndian, &keyLength); err != nil {
+			return nil, fmt.Errorf("%w: truncated index", ErrMalformedSnapshot)
+		}
+		key := make([]byte, keyLength)
+		if _, err := io.ReadFull(buffer, key); err != nil {
+			return nil, fmt.Errorf("%w: truncated index", ErrMalformedSnapshot)
+		}
+		var entry snapshotEntry
+		if err := binary.Read(buffer, binary.BigEndian, &entry); err != nil {
+			return nil, fmt.Errorf("%w: truncated index", ErrMalformedSnapshot)
+		}
+		if len(s.keys) > 0 && string(key) <= s.keys[len(s.keys)-1] {
+			return nil, fmt.Errorf("%w: index keys out of order", ErrMalformedSnapshot)
+		}
+		s.index[string(key)] = entry
+		s.keys = append(s.keys, string(key))
+		read += snapshotIndexEntrySize + int64(keyLength)
+	}
+
+	s.contents = read
+	available := uint64(size - read)
+	for _, entry := range s.index {
+		if entry.Offset > available || entry.Length > available-entry.Offset {
+			return nil, fmt.Errorf("%w: bucket out of range", ErrMalformedSnapshot)
+		}
+	}
+	return s, nil
+}
+
+// Get returns the contents of the bucket at key id, or an empty slice if the
+// snapshot has no such bucket
+func (s *Snapshot) Get(id string) ([]byte, error) {
+	entry, ok := s.index[id]
+	if !ok {
+		return []byte{}, nil
+	}
+	contents := make([]byte, entry.Length)
+	if _, err := s.r.ReadAt(contents, s.contents+int64(entry.Offset)); err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+// ForEach calls fn for every bucket in the snapshot in ascending key order,
+// stopping at the first error returned by fn
+func (s *Snapshot) ForEach(fn func(id string, value []byte) error) error {
+	for _, key := range s.keys {
+		contents, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+		if err := fn(key, contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of buckets in the snapshot
+func (s *Snapshot) Len() int {
+	return len(s.keys)
+}
+
+// Close closes the snapshot file, if it was opened with OpenSnapshot
+func (s *Snapshot) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// WriteSnapshot writes a snapshot of the buckets visited by forEach, such as
+// a store's ForEach method, along with the client configuration cfg. forEach
+// must visit buckets in ascending key order, and is called twice: once to
+// build the index and once to write the contents.
+func WriteSnapshot(w io.Writer, cfg Config, forEach func(fn func(id string, value []byte) error) error) error {
+	var keys []string
+	var lengths []uint64
+	err := forEach(func(id string, value []byte) error {
+		if len(id) > math.MaxUint16 {
+			return fmt.Errorf("bucket key too long to serialize: %q", id)
+		}
+		if len(keys) > 0 && id <= keys[len(keys)-1] {
+			return fmt.Errorf("bucket keys out of order: %q after %q", id, keys[len(keys)-1])
+		}
+		keys = append(keys, id)
+		lengths = append(lengths, uint64(len(value)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if uint64(len(keys)) > math.MaxUint32 {
+		return errors.New("too many buckets to serialize")
+	}
+	configData, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	buffer := bufio.NewWriter(w)
+	buffer.Write(snapshotMagic)
+	buffer.WriteByte(SnapshotVersion1)
+	if err := binary.Write(buffer, binary.BigEndian, uint32(len(configData))); err != nil {
+		return err
+	}
+	buffer.Write(configData)
+	if err := binary.Write(buffer, binary.BigEndian, uint32(len(keys))); err != nil {
+		return err
+	}
+	var offset uint64
+	for i, key := range keys {
+		if err := binary.Write(buffer, binary.BigEndian, uint16(len(key))); err != nil {
+			return err
+		}
+		buffer.WriteString(key)
+		if err := binary.Write(buffer, binary.BigEndian, snapshotEntry{Offset: offset, Length: lengths[i]}); err != nil {
+			return err
+		}
+		offset += lengths[i]
+	}
+
+	// the buckets must not have changed since the index was built
+	i := 0
+	err = forEach(func(id string, value []byte) error {
+		if i >= len(keys) || id != keys[i] || uint64(len(value)) != lengths[i] {
+			return errors.New("buckets changed while writing snapshot")
+		}
+		i++
+		_, err := buffer.Write(value)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if i != len(keys) {
+		return errors.New("buckets changed while writing snapshot")
+	}
+	return buffer.Flush()
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// forEach visits the buckets of kv in ascending key order
+func (kv *KVMock) forEach(fn func(id string, value []byte) error) error {
+	var keys []string
+	for key := range kv.store {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, kv.store[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestSnapshot answers queries from a snapshot as from the store it was
+// written from
+func TestSnapshot(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: make(map[string][]byte)}
+	credentials := []Credential{
+		{[]byte("username1"), []byte("password1")},
+		{[]byte("username2"), []byte("password2")},
+		{[]byte("username3"), []byte("password3")},
+	}
+	for _, credential := range credentials {
+		entry, err := server.EncryptBucketEntry(credential.Username, credential.Password, MetadataBreachedPassword, credential.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := server.BucketKey(credential.Username)
+		kv.store[key] = append(kv.store[key], entry...)
+	}
+
+	cfg, err := server.EpochConfig(server.Epoch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := WriteSnapshot(&buffer, cfg, kv.forEach); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := NewSnapshot(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, snapshot.Config) {
+		t.Fatalf("want config %+v, got %+v", cfg, snapshot.Config)
+	}
+	if snapshot.Len() != len(kv.store) {
+		t.Fatalf("want %d buckets, got %d", len(kv.store), snapshot.Len())
+	}
+
+	client, err := NewClient(snapshot.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := append(credentials, Credential{[]byte("username4"), []byte("password4")})
+	for i, credential := range queries {
+		request, reqContext, err := client.Request(credential.Username, credential.Password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := server.HandleRequest(request, snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, metadata, err := reqContext.Finalize(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < len(credentials) && (status != InBreach || !bytes.Equal(metadata, credential.Username)) {
+			t.Errorf("%s: want %s, got %s %q", credential.Username, InBreach, status, metadata)
+		}
+		if i == len(credentials) && status != NotInBreach {
+			t.Errorf("%s: want %s, got %s", credential.Username, NotInBreach, status)
+		}
+	}
+}
+
+func TestSnapshotMalformed(t *testing.T) {
+	kv := &KVMock{store: map[string][]byte{"00000001": []byte("one"), "00000002": []byte("two")}}
+	var buffer bytes.Buffer
+	if err := WriteSnapshot(&buffer, DefaultConfig(), kv.forEach); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+	for n := 0; n < len(data); n++ {
+		if _, err := NewSnapshot(bytes.NewReader(data[:n]), int64(n)); !errors.Is(err, ErrMalformedSnapshot) {
+			t.Fatalf("truncated to %d bytes: want %v, got %v", n, ErrMalformedSnapshot, err)
+		}
+	}
+
+	corrupt := append([]byte{}, data...)
+	corrupt[len(snapshotMagic)] = 0x02
+	if _, err := NewSnapshot(bytes.NewReader(corrupt), int64(len(corrupt))); !errors.Is(err, ErrMalformedSnapshot) {
+		t.Errorf("bad version: want %v, got %v", ErrMalformedSnapshot, err)
+	}
+
+	unordered := func(fn func(id string, value []byte) error) error {
+		for _, key := range []string{"00000002", "00000001"} {
+			if err := fn(key, kv.store[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := WriteSnapshot(new(bytes.Buffer), DefaultConfig(), unordered); err == nil {
+		t.Error("expected error writing buckets out of order")
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	fileBucketsName = []byte("kv_store")
+	fileShadowName  = []byte("kv_store_shadow")
+	fileMetaName    = []byte("kv_store_meta")
+)
+
+// fileStore implements Store with an embedded single-file database.
+type fileStore struct {
+	db *bolt.DB
+}
+
+// OpenFileStore opens the database file at path, creating it if needed.
+func OpenFileStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{fileBucketsName, fileShadowName, fileMetaName} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &fileStore{db: db}, nil
+}
+
+// shadowKey returns the key used for value in the shadow index. Entries are
+// indexed by digest to keep keys within the database's key size limit.
+func shadowKey(value []byte) []byte {
+	digest := sha256.Sum256(value)
+	return digest[:]
+}
+
+// Get returns the value in the key identified by id.
+func (f *fileStore) Get(id string) ([]byte, error) {
+	var value []byte
+	err := f.db.View(func(tx *bolt.Tx) error {
+		value = append([]byte{}, tx.Bucket(fileBucketsName).Get([]byte(id))...)
+		return nil
+	})
+	return value, err
+}
+
+// Put a value at key id and replace any existing value.
+func (f *fileStore) Put(id string, value []byte) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileBucketsName).Put([]byte(id), value)
+	})
+}
+
+// Append a value to any existing value at key id.
+func (f *fileStore) Append(id string, value []byte) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		shadow := tx.Bucket(fileShadowName)
+		key := shadowKey(value)
+		if shadow.Get(key) != nil {
+			return ErrDuplicate
+		}
+		if err := shadow.Put(key, []byte(id)); err != nil {
+			return err
+		}
+		buckets := tx.Bucket(fileBucketsName)
+		existing := buckets.Get([]byte(id))
+		newValue := make([]byte, 0, len(existing)+len(value))
+		newValue = append(append(newValue, existing...), value...)
+		return buckets.Put([]byte(id), newValue)
+	})
+}
+
+// AppendBatch appends entries that are not yet in the shadow index in a
+// single transaction, writing each affected bucket once.
+func (f *fileStore) AppendBatch(entries []Entry) (int, error) {
+	appended := 0
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		appended = 0
+		shadow := tx.Bucket(fileShadowName)
+		meta := tx.Bucket(fileMetaName)
+		pending := make(map[string][]byte)
+		var ids []string
+		for _, entry := range entries {
+			if entry.Value != nil {
+				key := shadowKey(entry.Value)
+				if shadow.Get(key) != nil {
+					continue
+				}
+				if err := shadow.Put(key, []byte(entry.ID)); err != nil {
+					return err
+				}
+				if _, ok := pending[entry.ID]; !ok {
+					ids = append(ids, entry.ID)
+				}
+				pending[entry.ID] = append(pending[entry.ID], entry.Value...)
+				appended++
+			}
+			for metaKey, value := range entry.Meta {
+				if err := meta.Put([]byte(metaKey), value); err != nil {
+					return err
+				}
+			}
+		}
+
+		buckets := tx.Bucket(fileBucketsName)
+		for _, id := range ids {
+			existing := buckets.Get([]byte(id))
+			newValue := make([]byte, 0, len(existing)+len(pending[id]))
+			newValue = append(append(newValue, existing...), pending[id]...)
+			if err := buckets.Put([]byte(id), newValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return appended, nil
+}
+
+// Remove replaces the value at key id if it is still expected, and removes
+// values from the shadow index and the metadata at metaKeys, in a single
+// transaction.
+func (f *fileStore) Remove(id string, expected, remaining []byte, values [][]byte, metaKeys []string) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		buckets := tx.Bucket(fileBucketsName)
+		if !bytes.Equal(buckets.Get([]byte(id)), expected) {
+			return ErrConflict
+		}
+		if err := buckets.Put([]byte(id), remaining); err != nil {
+			return err
+		}
+		shadow := tx.Bucket(fileShadowName)
+		for _, value := range values {
+			if err := shadow.Delete(shadowKey(value)); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(fileMetaName)
+		for _, key := range metaKeys {
+			if err := meta.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// IsUnique checks if the value is absent from the shadow index.
+func (f *fileStore) IsUnique(value []byte) (bool, error) {
+	unique := true
+	err := f.db.View(func(tx *bolt.Tx) error {
+		unique = tx.Bucket(fileShadowName).Get(shadowKey(value)) == nil
+		return nil
+	})
+	return unique, err
+}
+
+// GetMeta returns the metadata value at key.
+func (f *fileStore) GetMeta(key string) ([]byte, error) {
+	var value []byte
+	err := f.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(fileMetaName).Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// PutMeta stores a metadata value at key.
+func (f *fileStore) PutMeta(key string, value []byte) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileMetaName).Put([]byte(key), value)
+	})
+}
+
+// ForEach calls fn for every key in ascending order.
+func (f *fileStore) ForEach(fn func(id string, value []byte) error) error {
+	return f.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileBucketsName).ForEach(func(k, v []byte) error {
+			return fn(string(k), append([]byte{}, v...))
+		})
+	})
+}
+
+// ForEachMeta calls fn for every metadata key in ascending order.
+func (f *fileStore) ForEachMeta(fn func(key string, value []byte) error) error {
+	return f.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileMetaName).ForEach(func(k, v []byte) error {
+			return fn(string(k), append([]byte{}, v...))
+		})
+	})
+}
+
+// Close closes the underlying database file.
+func (f *fileStore) Close() error {
+	return f.db.Close()
+}
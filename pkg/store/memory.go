@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// memoryStore implements Store with in-memory maps. Its contents are lost
+// when the process exits, which makes it suitable for tests and local
+// development.
+type memoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string][]byte
+	shadow  map[string]struct{}
+	meta    map[string][]byte
+}
+
+// NewMemoryStore returns a new empty in-memory store.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		buckets: make(map[string][]byte),
+		shadow:  make(map[string]struct{}),
+		meta:    make(map[string][]byte),
+	}
+}
+
+// Get returns the value in the key identified by id.
+func (m *memoryStore) Get(id string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]byte{}, m.buckets[id]...), nil
+}
+
+// Put a value at key id and replace any existing value.
+func (m *memoryStore) Put(id string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buckets[id] = append([]byte{}, value...)
+	return nil
+}
+
+// Append a value to any existing value at key id.
+func (m *memoryStore) Append(id string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.shadow[string(value)]; ok {
+		return ErrDuplicate
+	}
+	m.shadow[string(value)] = struct{}{}
+	m.buckets[id] = append(m.buckets[id], value...)
+	return nil
+}
+
+// AppendBatch appends entries that are not yet in the shadow index.
+func (m *memoryStore) AppendBatch(entries []Entry) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	appended := 0
+	for _, entry := range entries {
+		if entry.Value != nil {
+			if _, ok := m.shadow[string(entry.Value)]; ok {
+				continue
+			}
+			m.shadow[string(entry.Value)] = struct{}{}
+			m.buckets[entry.ID] = append(m.buckets[entry.ID], entry.Value...)
+			appended++
+		}
+		for key, value := range entry.Meta {
+			m.meta[key] = append([]byte{}, value...)
+		}
+	}
+	return appended, nil
+}
+
+// Remove replaces the value at key id if it is still expected, and removes
+// values from the shadow index and the metadata at metaKeys.
+func (m *memoryStore) Remove(id string, expected, remaining []byte, values [][]byte, metaKeys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !bytes.Equal(m.buckets[id], expected) {
+		return ErrConflict
+	}
+	m.buckets[id] = append([]byte{}, remaining...)
+	for _, value := range values {
+		delete(m.shadow, string(value))
+	}
+	for _, key := range metaKeys {
+		delete(m.meta, key)
+	}
+	return nil
+}
+
+// IsUnique checks if the value is absent from the shadow index.
+func (m *memoryStore) IsUnique(value []byte) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.shadow[string(value)]
+	return !ok, nil
+}
+
+// GetMeta returns the metadata value at key.
+func (m *memoryStore) GetMeta(key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.meta[key]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, value...), nil
+}
+
+// PutMeta stores a metadata value at key.
+func (m *memoryStore) PutMeta(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.meta[key] = append([]byte{}, value...)
+	return nil
+}
+
+// ForEach calls fn for every key in ascending order.
+func (m *memoryStore) ForEach(fn func(id string, value []byte) error) error {
+	m.mu.RLock()
+	ids := make([]string, 0, len(m.buckets))
+	for id := range m.buckets {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		value, err := m.Get(id)
+		if err != nil {
+			return err
+		}
+		if err := fn(id, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachMeta calls fn for every metadata key in ascending order.
+func (m *memoryStore) ForEachMeta(fn func(key string, value []byte) error) error {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.meta))
+	for key := range m.meta {
+		keys = append(keys, key)
+	}
+	m.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, err := m.GetMeta(key)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			continue
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is a no-op for the in-memory store.
+func (m *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,368 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// DefaultPostgresPartitions is the number of hash partitions of the bucket
+// table created by OpenPostgresStore and NewPostgresStore
+const DefaultPostgresPartitions = 4
+
+// postgresStore implements Store with a PostgreSQL database.
+type postgresStore struct {
+	db *sql.DB
+}
+
+// OpenPostgresStore connects to the PostgreSQL database identified by the
+// connection string connStr and initializes a store in it.
+func OpenPostgresStore(connStr string) (Store, error) {
+	return OpenPostgresStoreWithPartitions(connStr, DefaultPostgresPartitions)
+}
+
+// OpenPostgresStoreWithPartitions is like OpenPostgresStore, but creates the
+// bucket table with the given number of hash partitions if it doesn't exist
+// yet. The partitioning of an existing table is left unchanged.
+func OpenPostgresStoreWithPartitions(connStr string, partitions int) (Store, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	kv, err := NewPostgresStoreWithPartitions(db, partitions)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return kv, nil
+}
+
+// NewPostgresStore initializes a new store with a PostgreSQL database connection.
+func NewPostgresStore(db *sql.DB) (Store, error) {
+	return NewPostgresStoreWithPartitions(db, DefaultPostgresPartitions)
+}
+
+// NewPostgresStoreWithPartitions is like NewPostgresStore, but creates the
+// bucket table with the given number of hash partitions if it doesn't exist
+// yet.
+func NewPostgresStoreWithPartitions(db *sql.DB, partitions int) (Store, error) {
+	if partitions < 1 {
+		return nil, errors.New("postgres store needs at least one partition")
+	}
+	kv := &postgresStore{db: db}
+
+	// Create the table if it doesn't exist. Partitions are only created
+	// along with the table, as adding partitions with a different modulus
+	// to an existing table would fail.
+	var exists bool
+	if err := db.QueryRow(`SELECT to_regclass('kv_store') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, err
+	}
+	var partitionQuery strings.Builder
+	if !exists {
+		for i := 0; i < partitions; i++ {
+			fmt.Fprintf(&partitionQuery, "\tCREATE TABLE IF NOT EXISTS kv_store_p%d PARTITION OF kv_store FOR VALUES WITH (MODULUS %d, REMAINDER %d);\n", i, partitions, i)
+		}
+	}
+	query := `
+	CREATE TABLE IF NOT EXISTS kv_store (
+		id TEXT NOT NULL,
+		value BYTEA,
+		PRIMARY KEY (id)
+	) PARTITION BY HASH (id);
+
+` + partitionQuery.String() + `
+	CREATE TABLE IF NOT EXISTS kv_store_shadow (
+		id TEXT,
+		value BYTEA,
+		PRIMARY KEY (id, value)
+	);
+
+	CREATE TABLE IF NOT EXISTS kv_store_meta (
+		key TEXT PRIMARY KEY,
+		value BYTEA
+	);
+	`
+	_, err := db.Exec(query)
+	if err != nil {
+		return nil, err
+	}
+	if err := kv.migrateShadowIndex(); err != nil {
+		return nil, err
+	}
+
+	return kv, nil
+}
+
+// migrateShadowIndex makes the shadow index global by value, as for the other
+// backends, if it isn't yet. Databases written by earlier versions only
+// rejected duplicates within a bucket, so the shadow rows of a value stored
+// in several buckets are first reduced to the one for the lowest bucket key.
+// The buckets themselves are left unchanged.
+func (kv *postgresStore) migrateShadowIndex() error {
+	var exists bool
+	if err := kv.db.QueryRow(`SELECT to_regclass('kv_store_shadow_unique_values') IS NOT NULL`).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	tx, err := kv.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`
+	DELETE FROM kv_store_shadow AS s
+	USING kv_store_shadow AS k
+	WHERE s.value = k.value AND s.id > k.id`)
+	if err != nil {
+		return err
+	}
+	dropped, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	CREATE UNIQUE INDEX IF NOT EXISTS kv_store_shadow_unique_values ON kv_store_shadow (value);
+	DROP INDEX IF EXISTS kv_store_shadow_values;`)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if dropped > 0 {
+		log.Printf("postgres store: dropped %d shadow rows of entries stored in more than one bucket, keeping the row for the lowest bucket key of each", dropped)
+	}
+	return nil
+}
+
+// Put a value at key id and replace any existing value.
+func (kv *postgresStore) Put(id string, value []byte) error {
+	query := `
+	INSERT INTO kv_store (id, value) VALUES ($1, $2)
+	ON CONFLICT (id) DO UPDATE SET value = $2;`
+	_, err := kv.db.Exec(query, id, value)
+	return err
+}
+
+// Append a value to any existing value at key id. The shadow insert and the
+// bucket update run as a single statement, so concurrent appends to the same
+// bucket cannot lose entries and the shadow table always agrees with
+// kv_store. If the shadow insert conflicts, no row is passed on to the bucket
+// update and the value is reported as a duplicate.
+func (kv *postgresStore) Append(id string, value []byte) error {
+	query := `
+	WITH shadow AS (
+		INSERT INTO kv_store_shadow (id, value) VALUES ($1, $2)
+		ON CONFLICT (value) DO NOTHING
+		RETURNING id, value
+	)
+	INSERT INTO kv_store (id, value) SELECT id, value FROM shadow
+	ON CONFLICT (id) DO UPDATE SET value = COALESCE(kv_store.value, ''::bytea) || EXCLUDED.value;`
+	result, err := kv.db.Exec(query, id, value)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDuplicate
+	}
+	return nil
+}
+
+// AppendBatch appends entries that are not yet in the shadow table with a
+// single multi-row statement. As with Append, the shadow insert and the
+// bucket updates happen atomically; the new entries are concatenated per
+// bucket on the server before being appended. The metadata of the entries is
+// joined against the shadow insert, so that only appended entries' metadata
+// is written, along with that of the entries without a value.
+func (kv *postgresStore) AppendBatch(entries []Entry) (int, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	ids := make([]string, 0, len(entries))
+	values := make([][]byte, 0, len(entries))
+	var metaEntries, metaValues, forcedValues [][]byte
+	var metaKeys, forcedKeys []string
+	for _, entry := range entries {
+		if entry.Value == nil {
+			for key, value := range entry.Meta {
+				forcedKeys = append(forcedKeys, key)
+				forcedValues = append(forcedValues, value)
+			}
+			continue
+		}
+		ids, values = append(ids, entry.ID), append(values, entry.Value)
+		for key, value := range entry.Meta {
+			metaEntries = append(metaEntries, entry.Value)
+			metaKeys = append(metaKeys, key)
+			metaValues = append(metaValues, value)
+		}
+	}
+
+	query := `
+	WITH shadow AS (
+		INSERT INTO kv_store_shadow (id, value)
+		SELECT id, value FROM unnest($1::text[], $2::bytea[]) AS batch (id, value)
+		ON CONFLICT (value) DO NOTHING
+		RETURNING id, value
+	), buckets AS (
+		INSERT INTO kv_store (id, value)
+		SELECT id, string_agg(value, ''::bytea) FROM shadow GROUP BY id ORDER BY id
+		ON CONFLICT (id) DO UPDATE SET value = COALESCE(kv_store.value, ''::bytea) || EXCLUDED.value
+	), meta AS (
+		INSERT INTO kv_store_meta (key, value)
+		SELECT DISTINCT ON (m.key) m.key, m.value FROM (
+			SELECT m.key, m.value
+			FROM unnest($3::bytea[], $4::text[], $5::bytea[]) AS m (entry, key, value)
+			JOIN shadow ON shadow.value = m.entry
+			UNION ALL
+			SELECT key, value FROM unnest($6::text[], $7::bytea[]) AS f (key, value)
+		) AS m
+		ORDER BY m.key
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value
+	)
+	SELECT count(*) FROM shadow;`
+	var appended int
+	err := kv.db.QueryRow(query, pq.Array(ids), pq.Array(values), pq.Array(metaEntries), pq.Array(metaKeys), pq.Array(metaValues),
+		pq.Array(forcedKeys), pq.Array(forcedValues)).Scan(&appended)
+	if err != nil {
+		return 0, err
+	}
+	return appended, nil
+}
+
+// Remove replaces the value at key id if it is still expected, and removes
+// values from the shadow table and the metadata at metaKeys. As with Append,
+// the bucket update and the deletes run as a single statement; the shadow
+// and metadata rows are only deleted if the bucket was updated.
+func (kv *postgresStore) Remove(id string, expected, remaining []byte, values [][]byte, metaKeys []string) error {
+	query := `
+	WITH bucket AS (
+		UPDATE kv_store SET value = $3
+		WHERE id = $1 AND COALESCE(value, ''::bytea) = $2
+		RETURNING id
+	), shadow AS (
+		DELETE FROM kv_store_shadow
+		WHERE id IN (SELECT id FROM bucket) AND value = ANY($4::bytea[])
+	), meta AS (
+		DELETE FROM kv_store_meta
+		WHERE EXISTS (SELECT 1 FROM bucket) AND key = ANY($5::text[])
+	)
+	SELECT count(*) FROM bucket;`
+	var updated int
+	if err := kv.db.QueryRow(query, id, expected, remaining, pq.Array(values), pq.Array(metaKeys)).Scan(&updated); err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// Get returns the value in the key identified by id.
+func (kv *postgresStore) Get(id string) ([]byte, error) {
+	query := `SELECT value FROM kv_store WHERE id = $1`
+	var value []byte
+	err := kv.db.QueryRow(query, id).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return []byte{}, nil
+		}
+		return nil, err
+	}
+	return value, nil
+}
+
+// IsUnique checks if the value is absent from the shadow table.
+func (kv *postgresStore) IsUnique(value []byte) (bool, error) {
+	query := `SELECT 1 FROM kv_store_shadow WHERE value = $1`
+	var exists int
+	err := kv.db.QueryRow(query, value).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return false, err
+}
+
+// GetMeta returns the metadata value at key.
+func (kv *postgresStore) GetMeta(key string) ([]byte, error) {
+	query := `SELECT value FROM kv_store_meta WHERE key = $1`
+	var value []byte
+	err := kv.db.QueryRow(query, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return value, err
+}
+
+// PutMeta stores a metadata value at key and replaces any existing value.
+func (kv *postgresStore) PutMeta(key string, value []byte) error {
+	query := `
+	INSERT INTO kv_store_meta (key, value) VALUES ($1, $2)
+	ON CONFLICT (key) DO UPDATE SET value = $2;`
+	_, err := kv.db.Exec(query, key, value)
+	return err
+}
+
+// ForEach calls fn for every key in ascending order.
+func (kv *postgresStore) ForEach(fn func(id string, value []byte) error) error {
+	rows, err := kv.db.Query(`SELECT id, value FROM kv_store ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var value []byte
+		if err := rows.Scan(&id, &value); err != nil {
+			return err
+		}
+		if err := fn(id, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ForEachMeta calls fn for every metadata key in ascending order.
+func (kv *postgresStore) ForEachMeta(fn func(key string, value []byte) error) error {
+	rows, err := kv.db.Query(`SELECT key, value FROM kv_store_meta ORDER BY key`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Close closes the database connection.
+func (kv *postgresStore) Close() error {
+	return kv.db.Close()
+}
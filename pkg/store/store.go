@@ -0,0 +1,106 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package store provides storage backends for MIGP bucket data. Each backend
+// maps a bucket identifier to the concatenation of the encrypted entries in
+// that bucket, and keeps a shadow index of every stored entry so that
+// duplicate entries can be detected at ingestion time.
+package store
+
+import (
+	"errors"
+)
+
+const (
+	BackendMemory   = "memory"
+	BackendFile     = "file"
+	BackendPostgres = "postgres"
+)
+
+// ErrDuplicate is returned by Append when the value is already present in
+// the shadow index.
+var ErrDuplicate = errors.New("duplicate entry")
+
+// ErrConflict is returned by Remove when the bucket no longer holds the
+// expected value.
+var ErrConflict = errors.New("bucket changed concurrently")
+
+// Entry is a single bucket entry to be appended to a store. Meta holds
+// metadata values to store along with the entry, which are only written if
+// the entry is appended. An entry with a nil Value appends nothing, and its
+// Meta is always written, e.g. to record progress along with a batch.
+type Entry struct {
+	ID    string
+	Value []byte
+	Meta  map[string][]byte
+}
+
+// Store is a generic interface for a MIGP bucket store. A Store also
+// implements the migp.Getter interface, and can therefore be passed directly
+// to migp.Server.HandleRequest.
+type Store interface {
+	// Get returns the value at key id, or an empty slice if no value is
+	// stored at id.
+	Get(id string) ([]byte, error)
+
+	// Put stores value at key id and replaces any existing value.
+	Put(id string, value []byte) error
+
+	// Append appends value to any existing value at key id and records
+	// value in the shadow index. It returns ErrDuplicate and leaves the
+	// store unchanged if value is already in the shadow index, whichever
+	// bucket it was stored in.
+	Append(id string, value []byte) error
+
+	// AppendBatch appends every entry as Append would, skipping entries
+	// whose value is already in the shadow index, including values repeated
+	// within the batch, and stores the metadata of each appended entry in
+	// the same transaction. Backends write the batch in as few round-trips
+	// as they can. It returns the number of entries appended.
+	AppendBatch(entries []Entry) (int, error)
+
+	// Remove replaces the value at key id with remaining, and removes values
+	// from the shadow index and the metadata at metaKeys, provided the value
+	// at id is still expected. It returns ErrConflict and leaves the store
+	// unchanged otherwise, e.g. if entries were appended to the bucket in the
+	// meantime.
+	Remove(id string, expected, remaining []byte, values [][]byte, metaKeys []string) error
+
+	// IsUnique reports whether value is absent from the shadow index.
+	IsUnique(value []byte) (bool, error)
+
+	// GetMeta returns the metadata value at key, or nil if there is none.
+	// Metadata is kept apart from buckets and is not visited by ForEach.
+	GetMeta(key string) ([]byte, error)
+
+	// PutMeta stores a metadata value at key and replaces any existing
+	// value.
+	PutMeta(key string, value []byte) error
+
+	// ForEach calls fn for every key in the store in ascending key order,
+	// stopping at the first error returned by fn.
+	ForEach(fn func(id string, value []byte) error) error
+
+	// ForEachMeta calls fn for every metadata key in ascending key order,
+	// stopping at the first error returned by fn.
+	ForEachMeta(fn func(key string, value []byte) error) error
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// Open returns a store for the given backend. The meaning of path depends on
+// the backend: it is ignored for the in-memory store, it is the database
+// file for the file store, and it is the connection string for PostgreSQL.
+func Open(backend, path string) (Store, error) {
+	switch backend {
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	case BackendFile:
+		return OpenFileStore(path)
+	case BackendPostgres:
+		return OpenPostgresStore(path)
+	default:
+		return nil, errors.New("unsupported store backend: " + backend)
+	}
+}
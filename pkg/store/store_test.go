@@ -0,0 +1,484 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testStores returns the backends to run the conformance tests against. The
+// PostgreSQL backend is only included if MIGP_TEST_POSTGRES is set to a
+// connection string for a scratch database, whose store tables are dropped.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	fileStore, err := OpenFileStore(filepath.Join(t.TempDir(), "migp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]Store{
+		BackendMemory: NewMemoryStore(),
+		BackendFile:   fileStore,
+	}
+	if db := testPostgresDB(t); db != nil {
+		pgStore, err := NewPostgresStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[BackendPostgres] = pgStore
+	}
+	for _, s := range stores {
+		t.Cleanup(func(s Store) func() {
+			return func() { s.Close() }
+		}(s))
+	}
+	return stores
+}
+
+// testPostgresDB connects to the scratch database given by MIGP_TEST_POSTGRES
+// and drops the store tables in it, or returns nil if it isn't set
+func testPostgresDB(t *testing.T) *sql.DB {
+	t.Helper()
+	connStr := os.Getenv("MIGP_TEST_POSTGRES")
+	if connStr == "" {
+		return nil
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DROP TABLE IF EXISTS kv_store, kv_store_shadow, kv_store_meta`); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestStore runs a series of operations against each backend
+func TestStore(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			value, err := s.Get("00000001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(value) != 0 {
+				t.Fatalf("empty bucket: want 0 bytes, got %d", len(value))
+			}
+
+			if err := s.Append("00000001", []byte("entry1")); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Append("00000001", []byte("entry2")); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Append("00000000", []byte("entry3")); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Append("00000001", []byte("entry1")); err != ErrDuplicate {
+				t.Fatalf("duplicate append: want %v, got %v", ErrDuplicate, err)
+			}
+			// the shadow index is global, not per bucket
+			if err := s.Append("00000002", []byte("entry1")); err != ErrDuplicate {
+				t.Fatalf("duplicate append to another bucket: want %v, got %v", ErrDuplicate, err)
+			}
+			value, err = s.Get("00000002")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(value) != 0 {
+				t.Fatalf("bucket of rejected duplicate: want 0 bytes, got %d", len(value))
+			}
+
+			value, err = s.Get("00000001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, []byte("entry1entry2")) {
+				t.Fatalf("append: want %q, got %q", "entry1entry2", value)
+			}
+
+			unique, err := s.IsUnique([]byte("entry2"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unique {
+				t.Fatal("stored entry reported as unique")
+			}
+			unique, err = s.IsUnique([]byte("entry4"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !unique {
+				t.Fatal("new entry reported as duplicate")
+			}
+
+			if err := s.Put("00000001", []byte("replaced")); err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			var values [][]byte
+			err = s.ForEach(func(id string, value []byte) error {
+				ids = append(ids, id)
+				values = append(values, value)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != 2 || ids[0] != "00000000" || ids[1] != "00000001" {
+				t.Fatalf("ForEach keys: want [00000000 00000001], got %v", ids)
+			}
+			if !bytes.Equal(values[0], []byte("entry3")) || !bytes.Equal(values[1], []byte("replaced")) {
+				t.Fatalf("ForEach values: got %q", values)
+			}
+		})
+	}
+}
+
+// TestOpen tests backend selection by name
+func TestOpen(t *testing.T) {
+	s, err := Open(BackendMemory, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = Open(BackendFile, filepath.Join(t.TempDir(), "migp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if _, err := Open("unknown", ""); err == nil {
+		t.Fatal("expected error for unknown backend")
+	}
+
+	// a failed open returns a nil Store, not a nil pointer in an interface
+	s, err = Open(BackendFile, filepath.Join(t.TempDir(), "missing", "migp.db"))
+	if err == nil || s != nil {
+		t.Fatalf("missing directory: want nil store and an error, got %v, %v", s, err)
+	}
+}
+
+// TestConcurrentAppend checks that concurrent appends to the same bucket do
+// not lose entries
+func TestConcurrentAppend(t *testing.T) {
+	const workers, entriesPerWorker = 8, 25
+
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			id := "0000abcd"
+			var wg sync.WaitGroup
+			errs := make(chan error, workers)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < entriesPerWorker; i++ {
+						// every worker also races to insert one shared entry
+						if err := s.Append(id, []byte("shared-entry")); err != nil && err != ErrDuplicate {
+							errs <- err
+							return
+						}
+						if err := s.Append(id, []byte(fmt.Sprintf("entry-%02d-%02d", w, i))); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			value, err := s.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantLen := workers*entriesPerWorker*len("entry-00-00") + len("shared-entry")
+			if len(value) != wantLen {
+				t.Fatalf("bucket length: want %d, got %d", wantLen, len(value))
+			}
+			for w := 0; w < workers; w++ {
+				for i := 0; i < entriesPerWorker; i++ {
+					if !bytes.Contains(value, []byte(fmt.Sprintf("entry-%02d-%02d", w, i))) {
+						t.Fatalf("entry-%02d-%02d lost", w, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestAppendBatch tests batched appends, including duplicates within and
+// across batches, and that only the metadata of appended entries and of
+// entries without a value is stored
+func TestAppendBatch(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.Append("00000002", []byte("entry0")); err != nil {
+				t.Fatal(err)
+			}
+			n, err := s.AppendBatch([]Entry{
+				{ID: "00000002", Value: []byte("entry1"), Meta: map[string][]byte{"test/entry1": []byte("meta1")}},
+				{ID: "00000003", Value: []byte("entry2")},
+				{ID: "00000002", Value: []byte("entry0"), Meta: map[string][]byte{"test/entry0": []byte("meta0")}},
+				{ID: "00000002", Value: []byte("entry1")},
+				{ID: "00000003", Value: []byte("entry3")},
+				{ID: "00000004", Value: []byte("entry2")},
+				{Meta: map[string][]byte{"test/progress": []byte("batch1")}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 3 {
+				t.Fatalf("appended: want 3, got %d", n)
+			}
+
+			value, err := s.Get("00000002")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, []byte("entry0entry1")) {
+				t.Fatalf("bucket 00000002: want %q, got %q", "entry0entry1", value)
+			}
+			value, err = s.Get("00000003")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(value) != len("entry2entry3") || !bytes.Contains(value, []byte("entry2")) || !bytes.Contains(value, []byte("entry3")) {
+				t.Fatalf("bucket 00000003: got %q", value)
+			}
+			value, err = s.Get("00000004")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(value) != 0 {
+				t.Fatalf("bucket 00000004: want the value stored in 00000003 rejected, got %q", value)
+			}
+			value, err = s.GetMeta("test/entry1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, []byte("meta1")) {
+				t.Fatalf("meta of appended entry: want %q, got %q", "meta1", value)
+			}
+			value, err = s.GetMeta("test/entry0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != nil {
+				t.Fatalf("meta of duplicate entry: want nil, got %q", value)
+			}
+			value, err = s.GetMeta("test/progress")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, []byte("batch1")) {
+				t.Fatalf("meta of entry without a value: want %q, got %q", "batch1", value)
+			}
+			var ids []string
+			err = s.ForEach(func(id string, value []byte) error {
+				ids = append(ids, id)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != 2 {
+				t.Fatalf("buckets: want [00000002 00000003], got %v", ids)
+			}
+
+			if n, err := s.AppendBatch(nil); err != nil || n != 0 {
+				t.Fatalf("empty batch: got %d, %v", n, err)
+			}
+		})
+	}
+}
+
+// TestMeta tests that metadata is stored apart from buckets
+func TestMeta(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			value, err := s.GetMeta("test/missing")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != nil {
+				t.Fatalf("missing key: want nil, got %q", value)
+			}
+
+			if err := s.PutMeta("test/key", []byte("value1")); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.PutMeta("test/key", []byte("value2")); err != nil {
+				t.Fatal(err)
+			}
+			value, err = s.GetMeta("test/key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, []byte("value2")) {
+				t.Fatalf("meta: want %q, got %q", "value2", value)
+			}
+
+			err = s.ForEach(func(id string, value []byte) error {
+				if id == "test/key" {
+					t.Fatal("ForEach visited a metadata key")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.PutMeta("test/another", []byte("value3")); err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			err = s.ForEachMeta(func(key string, value []byte) error {
+				keys = append(keys, key)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 2 || keys[0] != "test/another" || keys[1] != "test/key" {
+				t.Fatalf("ForEachMeta keys: want [test/another test/key], got %v", keys)
+			}
+		})
+	}
+}
+
+// TestRemove tests that entries can be removed from a bucket, the shadow
+// index and the metadata, and that a stale removal leaves the store unchanged
+func TestRemove(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, value := range []string{"entry1", "entry2", "entry3"} {
+				if err := s.Append("00000001", []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.PutMeta("test/entry2", []byte("meta2")); err != nil {
+				t.Fatal(err)
+			}
+			metaKeys := []string{"test/entry2", "test/missing"}
+
+			err := s.Remove("00000001", []byte("entry1entry2"), []byte("entry1"), [][]byte{[]byte("entry2")}, metaKeys)
+			if err != ErrConflict {
+				t.Fatalf("stale remove: want ErrConflict, got %v", err)
+			}
+			unique, err := s.IsUnique([]byte("entry2"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unique {
+				t.Fatal("stale remove changed the shadow index")
+			}
+			meta, err := s.GetMeta("test/entry2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta == nil {
+				t.Fatal("stale remove deleted metadata")
+			}
+
+			err = s.Remove("00000001", []byte("entry1entry2entry3"), []byte("entry1entry3"), [][]byte{[]byte("entry2")}, metaKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, err := s.Get("00000001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, []byte("entry1entry3")) {
+				t.Fatalf("bucket: want %q, got %q", "entry1entry3", value)
+			}
+			unique, err = s.IsUnique([]byte("entry2"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !unique {
+				t.Fatal("removed entry still in the shadow index")
+			}
+			unique, err = s.IsUnique([]byte("entry1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unique {
+				t.Fatal("remaining entry missing from the shadow index")
+			}
+			meta, err = s.GetMeta("test/entry2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta != nil {
+				t.Fatalf("metadata of removed entry: want nil, got %q", meta)
+			}
+
+			// a removed entry can be ingested again
+			if err := s.Append("00000001", []byte("entry2")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestPostgresShadowMigration opens a database written before the shadow
+// index was global, which holds an entry in two buckets
+func TestPostgresShadowMigration(t *testing.T) {
+	db := testPostgresDB(t)
+	if db == nil {
+		t.Skip("MIGP_TEST_POSTGRES not set")
+	}
+	defer db.Close()
+	_, err := db.Exec(`
+	CREATE TABLE kv_store (id TEXT NOT NULL, value BYTEA, PRIMARY KEY (id)) PARTITION BY HASH (id);
+	CREATE TABLE kv_store_p0 PARTITION OF kv_store FOR VALUES WITH (MODULUS 1, REMAINDER 0);
+	CREATE TABLE kv_store_shadow (id TEXT, value BYTEA, PRIMARY KEY (id, value));
+	CREATE INDEX kv_store_shadow_values ON kv_store_shadow (value);
+	INSERT INTO kv_store VALUES ('00000001', 'entry1entry2'), ('00000002', 'entry1');
+	INSERT INTO kv_store_shadow VALUES ('00000001', 'entry1'), ('00000001', 'entry2'), ('00000002', 'entry1');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewPostgresStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows int
+	if err := db.QueryRow(`SELECT count(*) FROM kv_store_shadow WHERE value = 'entry1'`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Fatalf("shadow rows of the duplicated entry: want 1, got %d", rows)
+	}
+	value, err := s.Get("00000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("entry1")) {
+		t.Fatalf("bucket 00000002: want %q, got %q", "entry1", value)
+	}
+	if err := s.Append("00000003", []byte("entry2")); err != ErrDuplicate {
+		t.Fatalf("duplicate append after migration: want %v, got %v", ErrDuplicate, err)
+	}
+
+	// the migration only runs once
+	if _, err := NewPostgresStore(db); err != nil {
+		t.Fatal(err)
+	}
+}